@@ -0,0 +1,140 @@
+package authbroker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Extension is the default amount of time by which RefreshToken extends a
+// token.
+const Extension = 10 * time.Second
+
+// Options configure an AuthBroker.
+type Options struct {
+	// Extension is the amount of time by which RefreshToken extends a
+	// token, unless overridden for the tenant by TenantExtension. Defaults to
+	// the Extension constant.
+	Extension       time.Duration
+	TenantExtension map[uint64]time.Duration
+	// MaxLifetime, if nonzero, bounds the expiration of a token and all of
+	// its refreshed descendants to MaxLifetime past its OriginalIssuedAt.
+	MaxLifetime time.Duration
+	// Revoked, if set, is consulted by RefreshToken.
+	Revoked *RevocationList
+	// Skew is the clock skew tolerated by RefreshToken, see Verifier.
+	Skew time.Duration
+}
+
+// AuthBroker mints tokens signed with the active key of its Keyring.
+type AuthBroker struct {
+	keyring *Keyring
+	opts    Options
+}
+
+// New returns an AuthBroker using the given Keyring.
+func New(keyring *Keyring, opts Options) *AuthBroker {
+	if opts.Extension == 0 {
+		opts.Extension = Extension
+	}
+	return &AuthBroker{keyring: keyring, opts: opts}
+}
+
+// Keyring returns the broker's Keyring. Its Public copy is what verifiers
+// need.
+func (ab *AuthBroker) Keyring() *Keyring {
+	return ab.keyring
+}
+
+// Verifier returns a Verifier that accepts the broker's tokens.
+func (ab *AuthBroker) Verifier() Verifier {
+	return Verifier{Keyring: ab.keyring, Revoked: ab.opts.Revoked, Skew: ab.opts.Skew}
+}
+
+// RevokeToken revokes the token with the given ID and all of its refreshed
+// descendants, if the broker has a RevocationList. Token revocations that no
+// longer matter are pruned from the list, so that it doesn't grow without
+// bound.
+func (ab *AuthBroker) RevokeToken(id uint64, now time.Time) error {
+	if ab.opts.Revoked == nil {
+		return errors.New("revocation is not enabled")
+	}
+	// All tokens with this ID were originally issued before now, so they
+	// expire before now+MaxLifetime, and verifiers accept them for up to
+	// Skew longer. Without a MaxLifetime, they may live forever.
+	var until time.Time
+	if ab.opts.MaxLifetime != 0 {
+		until = now.Add(ab.opts.MaxLifetime + ab.opts.Skew)
+	}
+	ab.opts.Revoked.Prune(now)
+	ab.opts.Revoked.RevokeToken(id, until)
+	return nil
+}
+
+// RevokeTenant revokes all tokens issued to the given tenant so far, if the
+// broker has a RevocationList. Like RevokeToken, it prunes the list.
+func (ab *AuthBroker) RevokeTenant(tenantID uint64, now time.Time) error {
+	if ab.opts.Revoked == nil {
+		return errors.New("revocation is not enabled")
+	}
+	ab.opts.Revoked.Prune(now)
+	ab.opts.Revoked.RevokeTenant(tenantID, now)
+	return nil
+}
+
+// maxExpiration returns the latest expiration any token refreshed from one
+// with the given claims may have, or the zero time if there is no limit.
+func (ab *AuthBroker) maxExpiration(claims Claims) time.Time {
+	if ab.opts.MaxLifetime == 0 {
+		return time.Time{}
+	}
+	return claims.OriginalIssuedAt.Add(ab.opts.MaxLifetime)
+}
+
+// MakeToken returns a token carrying the given claims. If not set, the ID is
+// chosen randomly and OriginalIssuedAt defaults to IssuedAt. The expiration
+// is capped by Options.MaxLifetime.
+func (ab *AuthBroker) MakeToken(claims Claims) (string, error) {
+	k, ok := ab.keyring.Active()
+	if !ok {
+		return "", errors.New("no active signing key")
+	}
+	if claims.ID == 0 {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", err
+		}
+		claims.ID = binary.LittleEndian.Uint64(b[:])
+	}
+	if claims.OriginalIssuedAt.IsZero() {
+		claims.OriginalIssuedAt = claims.IssuedAt
+	}
+	if max := ab.maxExpiration(claims); !max.IsZero() && claims.Expiration.After(max) {
+		claims.Expiration = max
+	}
+	return Token{Version: Version1, KeyID: k.ID, Claims: claims}.Sign(k.PrivateKey)
+}
+
+// RefreshToken verifies the given token and returns a new one carrying the
+// same claims, but issued at now and expiring later by the tenant's
+// extension. Tokens that have reached their maximum lifetime can't be
+// refreshed.
+func (ab *AuthBroker) RefreshToken(tok string, now time.Time) (string, error) {
+	t, err := ab.Verifier().Verify(tok, now)
+	if err != nil {
+		return "", err
+	}
+	claims := t.Claims
+	if max := ab.maxExpiration(claims); !max.IsZero() && !claims.Expiration.Before(max) {
+		return "", fmt.Errorf("token has reached its maximum lifetime of %s", ab.opts.MaxLifetime)
+	}
+	extension, ok := ab.opts.TenantExtension[claims.TenantID]
+	if !ok {
+		extension = ab.opts.Extension
+	}
+	claims.IssuedAt = now
+	claims.Expiration = claims.Expiration.Add(extension)
+	return ab.MakeToken(claims)
+}
@@ -0,0 +1,57 @@
+package authbroker
+
+import "strings"
+
+// A Capability is something the holder of a token is allowed to do.
+type Capability string
+
+const (
+	// CapabilityAdmin allows everything.
+	CapabilityAdmin Capability = "admin"
+	// CapabilitySQLRead allows read-only SQL.
+	CapabilitySQLRead Capability = "sql:read"
+	// CapabilitySQLWrite allows SQL that mutates data. It implies
+	// CapabilitySQLRead.
+	CapabilitySQLWrite Capability = "sql:write"
+
+	databasePrefix = "db:"
+)
+
+// DatabaseCapability returns the Capability to access the given database.
+// Tokens that carry no database capabilities may access all databases.
+func DatabaseCapability(db string) Capability {
+	return Capability(databasePrefix + db)
+}
+
+// Capabilities is the set of capabilities carried by a token.
+type Capabilities []Capability
+
+// Has returns whether the set contains the given Capability, taking into
+// account that CapabilityAdmin implies all others and CapabilitySQLWrite
+// implies CapabilitySQLRead.
+func (cs Capabilities) Has(c Capability) bool {
+	for _, have := range cs {
+		if have == c || have == CapabilityAdmin ||
+			(have == CapabilitySQLWrite && c == CapabilitySQLRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessDatabase returns whether the set allows access to the given
+// database: either it restricts access to specific databases, including this
+// one, or it doesn't restrict databases at all.
+func (cs Capabilities) CanAccessDatabase(db string) bool {
+	restricted := false
+	for _, c := range cs {
+		if !strings.HasPrefix(string(c), databasePrefix) {
+			continue
+		}
+		if c == DatabaseCapability(db) {
+			return true
+		}
+		restricted = true
+	}
+	return !restricted || cs.Has(CapabilityAdmin)
+}
@@ -0,0 +1,62 @@
+package authbroker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilities(t *testing.T) {
+	var none Capabilities
+	require.False(t, none.Has(CapabilitySQLRead))
+	require.True(t, none.CanAccessDatabase("defaultdb"))
+
+	ro := Capabilities{CapabilitySQLRead, DatabaseCapability("a"), DatabaseCapability("b")}
+	require.True(t, ro.Has(CapabilitySQLRead))
+	require.False(t, ro.Has(CapabilitySQLWrite))
+	require.False(t, ro.Has(CapabilityAdmin))
+	require.True(t, ro.CanAccessDatabase("a"))
+	require.True(t, ro.CanAccessDatabase("b"))
+	require.False(t, ro.CanAccessDatabase("c"))
+
+	rw := Capabilities{CapabilitySQLWrite}
+	require.True(t, rw.Has(CapabilitySQLRead))
+	require.True(t, rw.Has(CapabilitySQLWrite))
+	require.True(t, rw.CanAccessDatabase("c"))
+
+	admin := Capabilities{CapabilityAdmin, DatabaseCapability("a")}
+	require.True(t, admin.Has(CapabilitySQLWrite))
+	require.True(t, admin.CanAccessDatabase("c"))
+}
+
+func TestVerifierAudience(t *testing.T) {
+	ab := New(testKeyring(t, 1), Options{})
+	tok, err := ab.MakeToken(Claims{
+		TenantID:     5,
+		Expiration:   ts(100),
+		Audience:     "sql-proxy",
+		Capabilities: Capabilities{CapabilitySQLRead, DatabaseCapability("a")},
+	})
+	require.NoError(t, err)
+
+	v := ab.Verifier()
+	v.Audience = "sql-proxy"
+	tt, err := v.Verify(tok, ts(0))
+	require.NoError(t, err)
+	require.True(t, tt.Capabilities.Has(CapabilitySQLRead))
+	require.False(t, tt.Capabilities.Has(CapabilitySQLWrite))
+	require.True(t, tt.Capabilities.CanAccessDatabase("a"))
+
+	v.Audience = "kv"
+	_, err = v.Verify(tok, ts(0))
+	require.EqualError(t, err, `token is for audience "sql-proxy", not "kv"`)
+
+	// The broker itself accepts all audiences, so refreshing works and
+	// preserves audience and capabilities.
+	tok, err = ab.RefreshToken(tok, ts(0))
+	require.NoError(t, err)
+	v.Audience = "sql-proxy"
+	tt2, err := v.Verify(tok, ts(0))
+	require.NoError(t, err)
+	require.Equal(t, tt.Capabilities, tt2.Capabilities)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tbg/goplay/authbroker"
+)
+
+var options struct {
+	listenAddress   string
+	keyring         string
+	revocations     string
+	ttl             time.Duration
+	extension       time.Duration
+	tenantExtension tenantExtensions
+	maxLifetime     time.Duration
+	skew            time.Duration
+}
+
+// tenantExtensions is a flag.Value for authbroker.Options.TenantExtension,
+// given as tenant=duration, for example 5=1m. It can be repeated.
+type tenantExtensions map[uint64]time.Duration
+
+func (te *tenantExtensions) String() string {
+	var s []string
+	for id, d := range *te {
+		s = append(s, fmt.Sprintf("%d=%s", id, d))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (te *tenantExtensions) Set(v string) error {
+	for _, kv := range strings.Split(v, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return fmt.Errorf("expected tenant=duration, got %q", kv)
+		}
+		id, err := strconv.ParseUint(kv[:i], 10, 64)
+		if err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(kv[i+1:])
+		if err != nil {
+			return err
+		}
+		if *te == nil {
+			*te = tenantExtensions{}
+		}
+		(*te)[id] = d
+	}
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage:  %s [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.StringVar(&options.listenAddress, "listen", "127.0.0.1:8080",
+		"Listen address for HTTP requests")
+	flag.StringVar(&options.keyring, "keyring", "keyring.json",
+		"file containing the signing keys, see authbroker.Keyring")
+	flag.DurationVar(&options.ttl, "ttl", time.Hour,
+		"Lifetime of issued tokens, unless requested otherwise")
+	flag.StringVar(&options.revocations, "revocations", "revocations.json",
+		"file the revoked tokens and tenants are persisted to, created if it doesn't exist")
+	flag.DurationVar(&options.extension, "extension", authbroker.Extension,
+		"Amount of time by which refreshing extends a token")
+	flag.Var(&options.tenantExtension, "tenant-extension",
+		"Per-tenant override of -extension, as tenant=duration (comma-separated or repeated)")
+	flag.DurationVar(&options.maxLifetime, "max-lifetime", 24*time.Hour,
+		"Time after initial issuance past which tokens can't be refreshed (0 for no limit)")
+	flag.DurationVar(&options.skew, "skew", 5*time.Second,
+		"Clock skew tolerated when refreshing and introspecting tokens")
+	flag.Parse()
+
+	kr, err := authbroker.LoadKeyring(options.keyring)
+	if err != nil {
+		return err
+	}
+	if _, ok := kr.Active(); !ok {
+		return fmt.Errorf("keyring %s has no active key", options.keyring)
+	}
+
+	rl, err := authbroker.LoadRevocationList(options.revocations)
+	if os.IsNotExist(err) {
+		rl = authbroker.NewRevocationList()
+		err = rl.Save(options.revocations)
+	}
+	if err != nil {
+		return err
+	}
+	rl.Prune(time.Now())
+
+	ab := authbroker.New(kr, authbroker.Options{
+		Extension:       options.extension,
+		TenantExtension: options.tenantExtension,
+		MaxLifetime:     options.maxLifetime,
+		Revoked:         rl,
+		Skew:            options.skew,
+	})
+	srv := authbroker.NewServer(ab, authbroker.ServerOptions{
+		TTL:             options.ttl,
+		RevocationsFile: options.revocations,
+	})
+	log.Println("Listening on", options.listenAddress)
+	return http.ListenAndServe(options.listenAddress, srv)
+}
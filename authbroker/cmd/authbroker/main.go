@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tbg/goplay/authbroker"
+)
+
+const usage = `usage:  %[1]s <command> [options] [token]
+
+Commands:
+  keygen   add a new signing key to a keyring (creating it if needed) and
+           activate it, retiring the previously active key
+  mint     mint a token
+  refresh  refresh a token
+  verify   verify a token, checking that it isn't revoked, and print its
+           claims
+  inspect  print the claims of a token WITHOUT verifying it
+
+Commands that take a token read it from the command line or, if it is
+omitted or "-", from stdin. Run '%[1]s <command> -h' for the options of a
+command.
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command given by args. Usage information and warnings go to
+// stderr.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprintf(stderr, usage, os.Args[0])
+		return errors.New("no command given")
+	}
+	cmds := map[string]func(*flag.FlagSet, []string, io.Reader, io.Writer) error{
+		"keygen":  keygen,
+		"mint":    mint,
+		"refresh": refresh,
+		"verify":  verify,
+		"inspect": inspect,
+	}
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, usage, os.Args[0])
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage:  %s %s [options]\n", os.Args[0], args[0])
+		fs.PrintDefaults()
+	}
+	return cmd(fs, args[1:], stdin, stdout)
+}
+
+// capabilities is a flag.Value collecting repeated -capability flags.
+type capabilities authbroker.Capabilities
+
+func (cs *capabilities) String() string {
+	var s []string
+	for _, c := range *cs {
+		s = append(s, string(c))
+	}
+	return strings.Join(s, ",")
+}
+
+func (cs *capabilities) Set(s string) error {
+	*cs = append(*cs, authbroker.Capability(s))
+	return nil
+}
+
+// readToken returns the token passed as the only remaining argument, reading
+// it from stdin if it is missing or "-".
+func readToken(fs *flag.FlagSet, stdin io.Reader) (string, error) {
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		if fs.Arg(0) != "-" {
+			return fs.Arg(0), nil
+		}
+	default:
+		return "", fmt.Errorf("expected one token, got %d arguments", fs.NArg())
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// loadRevocations returns the revocation list in the given file. If the file
+// doesn't exist, a warning is printed to the output of fs and nil is
+// returned, so that revocations aren't silently ignored.
+func loadRevocations(fs *flag.FlagSet, path string) (*authbroker.RevocationList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	rl, err := authbroker.LoadRevocationList(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(fs.Output(), "warning: %s does not exist, not checking revocations\n", path)
+		return nil, nil
+	}
+	return rl, err
+}
+
+func printToken(stdout io.Writer, t authbroker.Token) error {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "%s\n", b)
+	return err
+}
+
+func keygen(fs *flag.FlagSet, args []string, _ io.Reader, stdout io.Writer) error {
+	keyringFile := fs.String("keyring", "keyring.json", "keyring file to add the key to")
+	publicFile := fs.String("public", "",
+		"if set, also write the public keyring (for verifiers) to this file")
+	expireAfter := fs.Duration("expire-retired", 0,
+		"if nonzero, expire the retired key after this long (should exceed the max token lifetime)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	kr, err := authbroker.LoadKeyring(*keyringFile)
+	if errors.Is(err, os.ErrNotExist) {
+		kr, err = authbroker.NewKeyring(), nil
+	}
+	if err != nil {
+		return err
+	}
+	var id uint32 = 1
+	for _, k := range kr.Keys() {
+		if k.ID >= id {
+			id = k.ID + 1
+		}
+	}
+	prev, hadPrev := kr.Active()
+	k, err := authbroker.GenerateKey(id, now)
+	if err != nil {
+		return err
+	}
+	if err := kr.Add(k); err != nil {
+		return err
+	}
+	if err := kr.Activate(id, now); err != nil {
+		return err
+	}
+	if hadPrev && *expireAfter != 0 {
+		if err := kr.Expire(prev.ID, now.Add(*expireAfter)); err != nil {
+			return err
+		}
+	}
+	if err := kr.Save(*keyringFile); err != nil {
+		return err
+	}
+	if *publicFile != "" {
+		if err := kr.Public().Save(*publicFile); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(stdout, "added and activated key %d\n", id)
+	return err
+}
+
+func mint(fs *flag.FlagSet, args []string, _ io.Reader, stdout io.Writer) error {
+	keyringFile := fs.String("keyring", "keyring.json", "keyring file with the signing key")
+	tenantID := fs.Uint64("tenant", 0, "tenant ID")
+	ttl := fs.Duration("ttl", time.Hour, "lifetime of the token")
+	audience := fs.String("audience", "", "audience of the token")
+	var caps capabilities
+	fs.Var(&caps, "capability", "capability to grant (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *tenantID == 0 {
+		return errors.New("-tenant is required")
+	}
+
+	kr, err := authbroker.LoadKeyring(*keyringFile)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	tok, err := authbroker.New(kr, authbroker.Options{}).MakeToken(authbroker.Claims{
+		TenantID:     *tenantID,
+		IssuedAt:     now,
+		Expiration:   now.Add(*ttl),
+		Audience:     *audience,
+		Capabilities: authbroker.Capabilities(caps),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, tok)
+	return err
+}
+
+func refresh(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	keyringFile := fs.String("keyring", "keyring.json", "keyring file with the signing key")
+	revocationsFile := fs.String("revocations", "revocations.json",
+		"revocation list of the broker, see authbroker-server (empty to not check revocations)")
+	extension := fs.Duration("extension", authbroker.Extension, "amount by which to extend the token")
+	maxLifetime := fs.Duration("max-lifetime", 24*time.Hour,
+		"time after initial issuance past which the token can't be refreshed (0 for no limit)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tok, err := readToken(fs, stdin)
+	if err != nil {
+		return err
+	}
+
+	kr, err := authbroker.LoadKeyring(*keyringFile)
+	if err != nil {
+		return err
+	}
+	rl, err := loadRevocations(fs, *revocationsFile)
+	if err != nil {
+		return err
+	}
+	ab := authbroker.New(kr, authbroker.Options{
+		Extension:   *extension,
+		MaxLifetime: *maxLifetime,
+		Revoked:     rl,
+	})
+	tok, err = ab.RefreshToken(tok, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, tok)
+	return err
+}
+
+func verify(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	keyringFile := fs.String("keyring", "keyring.json", "keyring file, possibly public")
+	revocationsFile := fs.String("revocations", "revocations.json",
+		"revocation list of the broker, see authbroker-server (empty to not check revocations)")
+	audience := fs.String("audience", "", "if set, the only audience accepted")
+	skew := fs.Duration("skew", 0, "tolerated clock skew")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tok, err := readToken(fs, stdin)
+	if err != nil {
+		return err
+	}
+
+	kr, err := authbroker.LoadKeyring(*keyringFile)
+	if err != nil {
+		return err
+	}
+	rl, err := loadRevocations(fs, *revocationsFile)
+	if err != nil {
+		return err
+	}
+	v := authbroker.Verifier{Keyring: kr, Revoked: rl, Audience: *audience, Skew: *skew}
+	t, err := v.Verify(tok, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return printToken(stdout, t)
+}
+
+func inspect(fs *flag.FlagSet, args []string, stdin io.Reader, stdout io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tok, err := readToken(fs, stdin)
+	if err != nil {
+		return err
+	}
+	t, err := authbroker.Decode(tok)
+	if err != nil {
+		return err
+	}
+	return printToken(stdout, t)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tbg/goplay/authbroker"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	keyring := filepath.Join(dir, "keyring.json")
+	public := filepath.Join(dir, "public.json")
+	revocations := filepath.Join(dir, "revocations.json")
+
+	// runCmd runs the command, returning its output and warnings.
+	runCmd := func(stdin string, args ...string) (string, string, error) {
+		var stdout, stderr strings.Builder
+		err := run(args, strings.NewReader(stdin), &stdout, &stderr)
+		return stdout.String(), stderr.String(), err
+	}
+	mustRun := func(stdin string, args ...string) string {
+		t.Helper()
+		stdout, _, err := runCmd(stdin, args...)
+		require.NoError(t, err)
+		return stdout
+	}
+	claims := func(out string) authbroker.Token {
+		t.Helper()
+		var tok authbroker.Token
+		require.NoError(t, json.Unmarshal([]byte(out), &tok))
+		return tok
+	}
+
+	require.Equal(t, "added and activated key 1\n",
+		mustRun("", "keygen", "-keyring", keyring, "-public", public))
+	tok := strings.TrimSpace(mustRun("", "mint", "-keyring", keyring, "-tenant", "5",
+		"-audience", "sql", "-capability", "sql:read"))
+
+	verified := claims(mustRun("", "verify", "-keyring", public, "-revocations", "", tok))
+	require.EqualValues(t, 5, verified.TenantID)
+	require.Equal(t, "sql", verified.Audience)
+	require.Equal(t, authbroker.Capabilities{"sql:read"}, verified.Capabilities)
+	require.Equal(t, verified, claims(mustRun(tok+"\n", "inspect")))
+
+	// Without a revocation list, verify says that it isn't checking
+	// revocations.
+	_, stderr, err := runCmd(tok, "verify", "-keyring", public, "-revocations", revocations)
+	require.NoError(t, err)
+	require.Contains(t, stderr, "not checking revocations")
+
+	refreshed := strings.TrimSpace(mustRun(tok, "refresh", "-keyring", keyring,
+		"-revocations", revocations, "-extension", "1m", "-"))
+	rt := claims(mustRun(refreshed, "verify", "-keyring", public, "-revocations", ""))
+	require.Equal(t, verified.ID, rt.ID)
+	require.Equal(t, verified.Expiration.Add(time.Minute), rt.Expiration)
+
+	// Revoked tokens are rejected by verify and refresh.
+	rl := authbroker.NewRevocationList()
+	rl.RevokeToken(verified.ID, rt.Expiration)
+	require.NoError(t, rl.Save(revocations))
+	_, _, err = runCmd(refreshed, "verify", "-keyring", public, "-revocations", revocations)
+	require.True(t, errors.Is(err, authbroker.ErrRevoked), "%v", err)
+	_, _, err = runCmd(refreshed, "refresh", "-keyring", keyring, "-revocations", revocations)
+	require.True(t, errors.Is(err, authbroker.ErrRevoked), "%v", err)
+
+	// Usage goes to stderr.
+	_, stderr, err = runCmd("", "frobnicate")
+	require.EqualError(t, err, `unknown command "frobnicate"`)
+	require.Contains(t, stderr, "Commands:")
+	_, stderr, err = runCmd("", "mint", "-h")
+	require.Error(t, err)
+	require.Contains(t, stderr, "-tenant")
+}
@@ -0,0 +1,320 @@
+package authbroker
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/sign"
+)
+
+// A Key is a signing key pair known to a Keyring.
+type Key struct {
+	ID         uint32
+	PublicKey  *[32]byte
+	PrivateKey *[64]byte // nil if only used for verification
+	Created    time.Time
+	// Retired is set when the key stops being used for signing. Tokens
+	// signed by it remain valid until Expires.
+	Retired time.Time
+	// Expires, if set, is the time from which tokens signed with this key
+	// are no longer accepted.
+	Expires time.Time
+}
+
+// GenerateKey returns a new Key with the given ID.
+func GenerateKey(id uint32, now time.Time) (Key, error) {
+	publicKey, privateKey, err := sign.GenerateKey(rand.Reader)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{ID: id, PublicKey: publicKey, PrivateKey: privateKey, Created: now}, nil
+}
+
+func (k Key) expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// A Keyring holds the keys of a broker or verifier. At most one key is
+// active, i.e. used to sign new tokens; all keys that have not expired are
+// used to verify tokens. Rotating keys amounts to adding a new key and
+// activating it, which retires the previously active key, and expiring the
+// old key once all tokens signed with it have expired.
+//
+// A Keyring is safe for concurrent use.
+type Keyring struct {
+	mu     sync.Mutex
+	keys   map[uint32]Key
+	active uint32 // zero if none
+}
+
+// NewKeyring returns an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[uint32]Key{}}
+}
+
+// Add adds a key. Key IDs must be nonzero and unique.
+func (kr *Keyring) Add(k Key) error {
+	if k.ID == 0 {
+		return errors.New("key ID must be nonzero")
+	}
+	if k.PublicKey == nil {
+		return fmt.Errorf("key %d has no public key", k.ID)
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[k.ID]; ok {
+		return fmt.Errorf("key %d already exists", k.ID)
+	}
+	kr.keys[k.ID] = k
+	return nil
+}
+
+// Activate makes the given key the one used for signing, retiring the
+// previously active key, if any.
+func (kr *Keyring) Activate(id uint32, now time.Time) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	k, ok := kr.keys[id]
+	if !ok {
+		return fmt.Errorf("key %d not found", id)
+	}
+	if k.PrivateKey == nil {
+		return fmt.Errorf("key %d has no private key", id)
+	}
+	if k.expired(now) || !k.Retired.IsZero() {
+		return fmt.Errorf("key %d is retired", id)
+	}
+	if kr.active != 0 && kr.active != id {
+		kr.retireLocked(kr.active, now)
+	}
+	kr.active = id
+	return nil
+}
+
+// Retire stops the given key from being used for signing. Tokens signed with
+// it remain valid until the key expires.
+func (kr *Keyring) Retire(id uint32, now time.Time) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[id]; !ok {
+		return fmt.Errorf("key %d not found", id)
+	}
+	kr.retireLocked(id, now)
+	return nil
+}
+
+func (kr *Keyring) retireLocked(id uint32, now time.Time) {
+	k := kr.keys[id]
+	if k.Retired.IsZero() {
+		k.Retired = now
+	}
+	kr.keys[id] = k
+	if kr.active == id {
+		kr.active = 0
+	}
+}
+
+// Expire sets the time from which tokens signed with the given key are
+// rejected. The key is retired, if it wasn't already.
+func (kr *Keyring) Expire(id uint32, at time.Time) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.keys[id]; !ok {
+		return fmt.Errorf("key %d not found", id)
+	}
+	kr.retireLocked(id, at)
+	k := kr.keys[id]
+	k.Expires = at
+	kr.keys[id] = k
+	return nil
+}
+
+// Prune removes the keys that have expired at the given time.
+func (kr *Keyring) Prune(now time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	for id, k := range kr.keys {
+		if k.expired(now) {
+			delete(kr.keys, id)
+		}
+	}
+}
+
+// Active returns the key used for signing.
+func (kr *Keyring) Active() (Key, bool) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	k, ok := kr.keys[kr.active]
+	return k, ok
+}
+
+// Keys returns all keys, ordered by ID.
+func (kr *Keyring) Keys() []Key {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	return kr.keysLocked()
+}
+
+func (kr *Keyring) keysLocked() []Key {
+	keys := make([]Key, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// Public returns a copy of the Keyring without private keys, suitable for
+// handing to verifiers.
+func (kr *Keyring) Public() *Keyring {
+	pub := NewKeyring()
+	for _, k := range kr.Keys() {
+		k.PrivateKey = nil
+		pub.keys[k.ID] = k
+	}
+	return pub
+}
+
+// Verify is like the package-level Verify, but uses the key the token claims
+// to be signed with, rejecting tokens whose key is unknown or expired.
+func (kr *Keyring) Verify(tok string, now time.Time) (Token, error) {
+	return kr.verify(tok, now, 0)
+}
+
+func (kr *Keyring) verify(tok string, now time.Time, skew time.Duration) (Token, error) {
+	// NB: the key ID isn't trustworthy until the signature is verified,
+	// but it can only make us pick a key that won't verify.
+	t, err := Decode(tok)
+	if err != nil {
+		return Token{}, err
+	}
+	kr.mu.Lock()
+	k, ok := kr.keys[t.KeyID]
+	kr.mu.Unlock()
+	if !ok {
+		return Token{}, fmt.Errorf("unknown key %d", t.KeyID)
+	}
+	if k.expired(now) {
+		return Token{}, fmt.Errorf("key %d has expired", t.KeyID)
+	}
+	return verify(tok, now, k.PublicKey, skew)
+}
+
+type keyJSON struct {
+	ID         uint32    `json:"id"`
+	PublicKey  []byte    `json:"public_key"`
+	PrivateKey []byte    `json:"private_key,omitempty"`
+	Created    time.Time `json:"created"`
+	Retired    time.Time `json:"retired"`
+	Expires    time.Time `json:"expires"`
+}
+
+type keyringJSON struct {
+	Active uint32    `json:"active,omitempty"`
+	Keys   []keyJSON `json:"keys"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (kr *Keyring) MarshalJSON() ([]byte, error) {
+	kr.mu.Lock()
+	j := keyringJSON{Active: kr.active}
+	keys := kr.keysLocked()
+	kr.mu.Unlock()
+	for _, k := range keys {
+		kj := keyJSON{ID: k.ID, PublicKey: k.PublicKey[:], Created: k.Created, Retired: k.Retired, Expires: k.Expires}
+		if k.PrivateKey != nil {
+			kj.PrivateKey = k.PrivateKey[:]
+		}
+		j.Keys = append(j.Keys, kj)
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (kr *Keyring) UnmarshalJSON(b []byte) error {
+	var j keyringJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	keys := map[uint32]Key{}
+	for _, kj := range j.Keys {
+		k := Key{ID: kj.ID, Created: kj.Created, Retired: kj.Retired, Expires: kj.Expires}
+		if len(kj.PublicKey) != 32 {
+			return fmt.Errorf("key %d: invalid public key", kj.ID)
+		}
+		k.PublicKey = new([32]byte)
+		copy(k.PublicKey[:], kj.PublicKey)
+		if kj.PrivateKey != nil {
+			if len(kj.PrivateKey) != 64 {
+				return fmt.Errorf("key %d: invalid private key", kj.ID)
+			}
+			k.PrivateKey = new([64]byte)
+			copy(k.PrivateKey[:], kj.PrivateKey)
+		}
+		if _, ok := keys[k.ID]; ok || k.ID == 0 {
+			return fmt.Errorf("invalid or duplicate key ID %d", k.ID)
+		}
+		keys[k.ID] = k
+	}
+	if _, ok := keys[j.Active]; j.Active != 0 && !ok {
+		return fmt.Errorf("active key %d not found", j.Active)
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = keys
+	kr.active = j.Active
+	return nil
+}
+
+// Save writes the Keyring to the given file, atomically replacing it. Since
+// the file contains private keys, it is only readable by its owner.
+func (kr *Keyring) Save(path string) error {
+	b, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic writes the file by replacing it with a temporary file, which
+// is only readable by its owner.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadKeyring reads a Keyring written by Save.
+func LoadKeyring(path string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kr := NewKeyring()
+	if err := json.Unmarshal(b, kr); err != nil {
+		return nil, fmt.Errorf("loading keyring %s: %v", path, err)
+	}
+	return kr, nil
+}
@@ -0,0 +1,117 @@
+package authbroker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testKeyring returns a Keyring with a single, active key of the given ID.
+func testKeyring(t testing.TB, id uint32) *Keyring {
+	kr := NewKeyring()
+	k, err := GenerateKey(id, ts(0))
+	require.NoError(t, err)
+	require.NoError(t, kr.Add(k))
+	require.NoError(t, kr.Activate(id, ts(0)))
+	return kr
+}
+
+func TestKeyringRotation(t *testing.T) {
+	kr := testKeyring(t, 1)
+	ab := New(kr, Options{})
+	verifier := kr.Public()
+
+	claims := Claims{TenantID: 5, IssuedAt: ts(10), Expiration: ts(100)}
+	tok1, err := ab.MakeToken(claims)
+	require.NoError(t, err)
+
+	// Rotate to key 2.
+	k2, err := GenerateKey(2, ts(20))
+	require.NoError(t, err)
+	require.NoError(t, kr.Add(k2))
+	require.NoError(t, kr.Activate(2, ts(20)))
+	tok2, err := ab.MakeToken(claims)
+	require.NoError(t, err)
+
+	active, ok := kr.Active()
+	require.True(t, ok)
+	require.EqualValues(t, 2, active.ID)
+	require.Equal(t, ts(20), kr.Keys()[0].Retired)
+	require.Error(t, kr.Activate(1, ts(21)), "retired keys can't be reactivated")
+
+	// The verifier hasn't learned about key 2 yet.
+	tt, err := verifier.Verify(tok1, ts(30))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, tt.KeyID)
+	_, err = verifier.Verify(tok2, ts(30))
+	require.EqualError(t, err, "unknown key 2")
+
+	// The broker's keyring knows both.
+	verifier = kr.Public()
+	for _, tok := range []string{tok1, tok2} {
+		_, err := verifier.Verify(tok, ts(30))
+		require.NoError(t, err)
+	}
+	_, ok = verifier.Active()
+	require.False(t, ok)
+	for _, k := range verifier.Keys() {
+		require.Nil(t, k.PrivateKey)
+	}
+
+	// Expire key 1.
+	require.NoError(t, kr.Expire(1, ts(50)))
+	_, err = kr.Verify(tok1, ts(49))
+	require.NoError(t, err)
+	_, err = kr.Verify(tok1, ts(50))
+	require.EqualError(t, err, "key 1 has expired")
+	kr.Prune(ts(50))
+	require.Len(t, kr.Keys(), 1)
+	_, err = kr.Verify(tok1, ts(50))
+	require.EqualError(t, err, "unknown key 1")
+
+	// Retiring the active key stops the broker from signing.
+	require.NoError(t, kr.Retire(2, ts(60)))
+	_, err = ab.MakeToken(claims)
+	require.EqualError(t, err, "no active signing key")
+	_, err = kr.Verify(tok2, ts(60))
+	require.NoError(t, err)
+}
+
+func TestKeyringPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "keyring.json")
+
+	kr := testKeyring(t, 1)
+	k2, err := GenerateKey(2, ts(20))
+	require.NoError(t, err)
+	require.NoError(t, kr.Add(k2))
+	require.NoError(t, kr.Expire(2, ts(1000)))
+	require.NoError(t, kr.Save(path))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	loaded, err := LoadKeyring(path)
+	require.NoError(t, err)
+	require.Equal(t, kr.Keys(), loaded.Keys())
+	active, ok := loaded.Active()
+	require.True(t, ok)
+	require.EqualValues(t, 1, active.ID)
+
+	// Overwriting works, and public keyrings (which have no active key)
+	// round-trip too.
+	require.NoError(t, kr.Public().Save(path))
+	loaded, err = LoadKeyring(path)
+	require.NoError(t, err)
+	require.Equal(t, kr.Public().Keys(), loaded.Keys())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"active": 3, "keys": []}`), 0600))
+	_, err = LoadKeyring(path)
+	require.Error(t, err)
+}
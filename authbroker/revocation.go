@@ -0,0 +1,173 @@
+package authbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrRevoked is returned (possibly wrapped) when verifying a revoked token.
+var ErrRevoked = errors.New("token has been revoked")
+
+// A RevocationList records revoked tokens and tenants. Brokers add to it, and
+// verifiers receive copies of it (for example, via the /revocations endpoint
+// of Server) which they Merge into their own.
+//
+// A RevocationList is safe for concurrent use.
+type RevocationList struct {
+	mu sync.Mutex
+	// tokens maps the ID of each revoked token to the time after which it
+	// can be forgotten, since tokens with that ID are expired by then.
+	tokens map[uint64]time.Time
+	// tenants maps a tenant ID to the time before which all tokens
+	// originally issued to the tenant are revoked.
+	tenants map[uint64]time.Time
+}
+
+// NewRevocationList returns an empty RevocationList.
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		tokens:  map[uint64]time.Time{},
+		tenants: map[uint64]time.Time{},
+	}
+}
+
+// RevokeToken revokes the token with the given ID, and all tokens refreshed
+// from it. The revocation can be forgotten after until, which should be no
+// earlier than the latest expiration any such token can have. A zero until
+// means that the revocation is kept forever.
+func (rl *RevocationList) RevokeToken(id uint64, until time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	prev, ok := rl.tokens[id]
+	if !ok || (!prev.IsZero() && (until.IsZero() || until.After(prev))) {
+		rl.tokens[id] = until
+	}
+}
+
+// RevokeTenant revokes all tokens originally issued to the given tenant before
+// the given time. Tokens minted later are unaffected.
+func (rl *RevocationList) RevokeTenant(tenantID uint64, issuedBefore time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if issuedBefore.After(rl.tenants[tenantID]) {
+		rl.tenants[tenantID] = issuedBefore
+	}
+}
+
+// Check returns an error wrapping ErrRevoked if the token has been revoked.
+func (rl *RevocationList) Check(t Token) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.tokens[t.ID]; ok {
+		return fmt.Errorf("token %d: %w", t.ID, ErrRevoked)
+	}
+	if before, ok := rl.tenants[t.TenantID]; ok && t.OriginalIssuedAt.Before(before) {
+		return fmt.Errorf("tenant %d: %w", t.TenantID, ErrRevoked)
+	}
+	return nil
+}
+
+// Prune forgets token revocations that no longer matter at the given time.
+func (rl *RevocationList) Prune(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for id, until := range rl.tokens {
+		if !until.IsZero() && until.Before(now) {
+			delete(rl.tokens, id)
+		}
+	}
+}
+
+// Merge adds all revocations in other to rl.
+func (rl *RevocationList) Merge(other *RevocationList) {
+	other.mu.Lock()
+	tokens := make(map[uint64]time.Time, len(other.tokens))
+	for id, until := range other.tokens {
+		tokens[id] = until
+	}
+	tenants := make(map[uint64]time.Time, len(other.tenants))
+	for id, before := range other.tenants {
+		tenants[id] = before
+	}
+	other.mu.Unlock()
+
+	for id, until := range tokens {
+		rl.RevokeToken(id, until)
+	}
+	for id, before := range tenants {
+		rl.RevokeTenant(id, before)
+	}
+}
+
+type tokenRevocationJSON struct {
+	ID    uint64    `json:"id"`
+	Until time.Time `json:"until"`
+}
+
+type tenantRevocationJSON struct {
+	ID           uint64    `json:"id"`
+	IssuedBefore time.Time `json:"issued_before"`
+}
+
+type revocationListJSON struct {
+	Tokens  []tokenRevocationJSON  `json:"tokens"`
+	Tenants []tenantRevocationJSON `json:"tenants"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (rl *RevocationList) MarshalJSON() ([]byte, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	j := revocationListJSON{}
+	for id, until := range rl.tokens {
+		j.Tokens = append(j.Tokens, tokenRevocationJSON{ID: id, Until: until})
+	}
+	for id, before := range rl.tenants {
+		j.Tenants = append(j.Tenants, tenantRevocationJSON{ID: id, IssuedBefore: before})
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, adding to any revocations
+// already present.
+func (rl *RevocationList) UnmarshalJSON(b []byte) error {
+	var j revocationListJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	for _, tok := range j.Tokens {
+		rl.RevokeToken(tok.ID, tok.Until)
+	}
+	for _, tenant := range j.Tenants {
+		rl.RevokeTenant(tenant.ID, tenant.IssuedBefore)
+	}
+	return nil
+}
+
+// Save writes the RevocationList to the given file, atomically replacing it.
+// Brokers need to save it after each revocation, since restarting with a
+// list that is missing revocations would make revoked tokens valid again.
+func (rl *RevocationList) Save(path string) error {
+	b, err := json.MarshalIndent(rl, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// LoadRevocationList reads a RevocationList written by Save.
+func LoadRevocationList(path string) (*RevocationList, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rl := NewRevocationList()
+	if err := json.Unmarshal(b, rl); err != nil {
+		return nil, fmt.Errorf("loading revocation list %s: %v", path, err)
+	}
+	return rl, nil
+}
@@ -0,0 +1,166 @@
+package authbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshMaxLifetime(t *testing.T) {
+	ab := New(testKeyring(t, 1), Options{
+		MaxLifetime:     25 * time.Second,
+		TenantExtension: map[uint64]time.Duration{7: time.Second},
+	})
+	v := ab.Verifier()
+
+	tok, err := ab.MakeToken(Claims{TenantID: 5, IssuedAt: ts(100), Expiration: ts(110)})
+	require.NoError(t, err)
+	orig, err := v.Verify(tok, ts(100))
+	require.NoError(t, err)
+	require.NotZero(t, orig.ID)
+	require.Equal(t, ts(100), orig.OriginalIssuedAt)
+
+	// 110 -> 120 -> 125 (capped) -> no more.
+	var exps []time.Time
+	for now := int64(101); ; now++ {
+		tok, err = ab.RefreshToken(tok, ts(now))
+		if err != nil {
+			require.EqualError(t, err, "token has reached its maximum lifetime of 25s")
+			break
+		}
+		tt, err := v.Verify(tok, ts(now))
+		require.NoError(t, err)
+		require.Equal(t, orig.ID, tt.ID)
+		require.Equal(t, orig.OriginalIssuedAt, tt.OriginalIssuedAt)
+		require.Equal(t, ts(now), tt.IssuedAt)
+		exps = append(exps, tt.Expiration)
+	}
+	require.Equal(t, []time.Time{ts(120), ts(125)}, exps)
+
+	// Minting beyond the max lifetime is capped too.
+	tok, err = ab.MakeToken(Claims{TenantID: 5, IssuedAt: ts(100), Expiration: ts(1000)})
+	require.NoError(t, err)
+	tt, err := v.Verify(tok, ts(100))
+	require.NoError(t, err)
+	require.Equal(t, ts(125), tt.Expiration)
+
+	// Tenant 7 has a custom extension.
+	tok, err = ab.MakeToken(Claims{TenantID: 7, IssuedAt: ts(100), Expiration: ts(110)})
+	require.NoError(t, err)
+	tok, err = ab.RefreshToken(tok, ts(101))
+	require.NoError(t, err)
+	tt, err = v.Verify(tok, ts(101))
+	require.NoError(t, err)
+	require.Equal(t, ts(111), tt.Expiration)
+}
+
+func TestRevocation(t *testing.T) {
+	rl := NewRevocationList()
+	ab := New(testKeyring(t, 1), Options{Revoked: rl, MaxLifetime: time.Hour})
+	v := ab.Verifier()
+
+	mint := func(tenantID uint64, now int64) string {
+		tok, err := ab.MakeToken(Claims{TenantID: tenantID, IssuedAt: ts(now), Expiration: ts(now + 100)})
+		require.NoError(t, err)
+		return tok
+	}
+	requireRevoked := func(tok string, now int64) {
+		t.Helper()
+		_, err := v.Verify(tok, ts(now))
+		require.True(t, errors.Is(err, ErrRevoked), "%v", err)
+		_, err = ab.RefreshToken(tok, ts(now))
+		require.True(t, errors.Is(err, ErrRevoked), "%v", err)
+	}
+
+	tok1 := mint(5, 10)
+	tok2 := mint(5, 10)
+	refreshed, err := ab.RefreshToken(tok1, ts(20))
+	require.NoError(t, err)
+
+	t1, err := Decode(tok1)
+	require.NoError(t, err)
+	require.NoError(t, ab.RevokeToken(t1.ID, ts(30)))
+	requireRevoked(tok1, 30)
+	requireRevoked(refreshed, 30)
+	_, err = v.Verify(tok2, ts(30))
+	require.NoError(t, err)
+
+	// Revoking the tenant revokes tok2 but not tokens minted later.
+	require.NoError(t, ab.RevokeTenant(5, ts(40)))
+	requireRevoked(tok2, 40)
+	_, err = v.Verify(mint(5, 40), ts(40))
+	require.NoError(t, err)
+	_, err = v.Verify(mint(6, 10), ts(40))
+	require.NoError(t, err)
+
+	// Distribute to a verifier.
+	b, err := json.Marshal(rl)
+	require.NoError(t, err)
+	remote := NewRevocationList()
+	require.NoError(t, json.Unmarshal(b, remote))
+	other := NewRevocationList()
+	other.Merge(remote)
+	remoteV := Verifier{Keyring: ab.Keyring().Public(), Revoked: other}
+	_, err = remoteV.Verify(refreshed, ts(50))
+	require.True(t, errors.Is(err, ErrRevoked), "%v", err)
+	_, err = remoteV.Verify(tok2, ts(50))
+	require.True(t, errors.Is(err, ErrRevoked), "%v", err)
+
+	// Token revocations are forgotten after the max lifetime, tenant ones
+	// aren't.
+	t3, err := Decode(mint(6, 10))
+	require.NoError(t, err)
+	require.NoError(t, ab.RevokeToken(t3.ID, ts(30)))
+	require.Error(t, rl.Check(t3))
+	rl.Prune(ts(31).Add(time.Hour))
+	require.NoError(t, rl.Check(t3))
+	rl.RevokeToken(t3.ID, time.Time{})
+	rl.Prune(ts(1 << 40))
+	require.Error(t, rl.Check(t3))
+	t2, err := Decode(tok2)
+	require.NoError(t, err)
+	require.Error(t, rl.Check(t2))
+
+	// Without a RevocationList, revoking fails.
+	require.Error(t, New(testKeyring(t, 1), Options{}).RevokeToken(1, ts(0)))
+}
+
+func TestRevocationSkewAndPrune(t *testing.T) {
+	rl := NewRevocationList()
+	ab := New(testKeyring(t, 1), Options{Revoked: rl, MaxLifetime: time.Hour, Skew: 5 * time.Second})
+	require.NoError(t, ab.RevokeToken(1, ts(0)))
+	// Verifiers accept tokens for up to Skew past their expiration, so the
+	// revocation is kept for that long as well.
+	rl.Prune(ts(4).Add(time.Hour))
+	require.Error(t, rl.Check(Token{Claims: Claims{ID: 1}}))
+
+	// Revoking prunes revocations that no longer matter.
+	require.NoError(t, ab.RevokeToken(2, ts(6).Add(time.Hour)))
+	require.NoError(t, rl.Check(Token{Claims: Claims{ID: 1}}))
+	require.Error(t, rl.Check(Token{Claims: Claims{ID: 2}}))
+}
+
+func TestRevocationListSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	_, err := LoadRevocationList(path)
+	require.True(t, os.IsNotExist(err), "%v", err)
+
+	rl := NewRevocationList()
+	rl.RevokeToken(1, ts(100))
+	rl.RevokeTenant(5, ts(50))
+	require.NoError(t, rl.Save(path))
+	loaded, err := LoadRevocationList(path)
+	require.NoError(t, err)
+	require.Error(t, loaded.Check(Token{Claims: Claims{ID: 1}}))
+	require.Error(t, loaded.Check(Token{Claims: Claims{ID: 2, TenantID: 5, OriginalIssuedAt: ts(10)}}))
+	require.NoError(t, loaded.Check(Token{Claims: Claims{ID: 2, TenantID: 5, OriginalIssuedAt: ts(60)}}))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"tokens": 3}`), 0600))
+	_, err = LoadRevocationList(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,286 @@
+package authbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServerOptions configure a Server.
+type ServerOptions struct {
+	// TTL is the lifetime of tokens issued by the /token endpoint if the
+	// request does not specify one. Defaults to one hour.
+	TTL time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+	// RevocationsFile, if set, is the file the RevocationList of the
+	// AuthBroker is saved to after each revocation, see
+	// LoadRevocationList. A revocation is only acknowledged once saved.
+	RevocationsFile string
+}
+
+// Server exposes an AuthBroker over HTTP. All endpoints exchange JSON:
+//
+//	POST /token       {"tenant_id": 5, "ttl": "10m", "not_before": "2020-...",
+//	                   "audience": "sql-proxy", "capabilities": ["sql:read"]}
+//	                                                                 -> tokenResponse
+//	POST /refresh     {"token": ...}                                 -> tokenResponse
+//	POST /introspect  {"token": ...}                                 -> introspectResponse
+//	GET  /keys        the public Keyring, see LoadKeyring
+//	POST /revoke      {"token_id": 123} or {"tenant_id": 5}
+//	GET  /revocations the RevocationList, see RevocationList.Merge
+//
+// Tokens are in their text form, see FormatToken. The Server does not
+// authenticate its callers, so /token and /revoke must only be reachable by
+// trusted parties.
+type Server struct {
+	ab   *AuthBroker
+	opts ServerOptions
+	mux  *http.ServeMux
+	// saveMu serializes saving the RevocationList, so that an older copy
+	// can't replace a newer one.
+	saveMu sync.Mutex
+}
+
+var _ http.Handler = (*Server)(nil)
+
+// NewServer returns a Server for the given AuthBroker.
+func NewServer(ab *AuthBroker, opts ServerOptions) *Server {
+	if opts.TTL == 0 {
+		opts.TTL = time.Hour
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	s := &Server{ab: ab, opts: opts, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/token", s.handleToken)
+	s.mux.HandleFunc("/refresh", s.handleRefresh)
+	s.mux.HandleFunc("/introspect", s.handleIntrospect)
+	s.mux.HandleFunc("/keys", s.handleKeys)
+	s.mux.HandleFunc("/revoke", s.handleRevoke)
+	s.mux.HandleFunc("/revocations", s.handleRevocations)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	dd, err := time.ParseDuration(s)
+	*d = duration(dd)
+	return err
+}
+
+type tokenRequest struct {
+	TenantID     uint64       `json:"tenant_id"`
+	TTL          duration     `json:"ttl"`
+	NotBefore    time.Time    `json:"not_before"`
+	Audience     string       `json:"audience"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+type refreshRequest struct {
+	Token string `json:"token"`
+}
+
+type revokeRequest struct {
+	TokenID  uint64 `json:"token_id"`
+	TenantID uint64 `json:"tenant_id"`
+}
+
+type tokenResponse struct {
+	Token      string    `json:"token"`
+	Expiration time.Time `json:"expiration"`
+}
+
+type introspectResponse struct {
+	// Active is false if the token did not verify, in which case Error says
+	// why and the claims are omitted.
+	Active           bool         `json:"active"`
+	Error            string       `json:"error,omitempty"`
+	KeyID            uint32       `json:"key_id,omitempty"`
+	TokenID          uint64       `json:"token_id,omitempty"`
+	TenantID         uint64       `json:"tenant_id,omitempty"`
+	OriginalIssuedAt *time.Time   `json:"original_issued_at,omitempty"`
+	IssuedAt         *time.Time   `json:"issued_at,omitempty"`
+	NotBefore        *time.Time   `json:"not_before,omitempty"`
+	Expiration       *time.Time   `json:"expiration,omitempty"`
+	Audience         string       `json:"audience,omitempty"`
+	Capabilities     Capabilities `json:"capabilities,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// readRequest decodes the JSON body of a POST request into v, writing an
+// error response and returning false if that fails.
+func readRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, struct{}{})
+		return false
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) writeToken(w http.ResponseWriter, tok string) {
+	t, err := Decode(tok)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokenResponse{Token: tok, Expiration: t.Expiration})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	ttl := time.Duration(req.TTL)
+	if ttl == 0 {
+		ttl = s.opts.TTL
+	}
+	now := s.opts.Now().UTC()
+	tok, err := s.ab.MakeToken(Claims{
+		TenantID:     req.TenantID,
+		IssuedAt:     now,
+		NotBefore:    req.NotBefore,
+		Expiration:   now.Add(ttl),
+		Audience:     req.Audience,
+		Capabilities: req.Capabilities,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeToken(w, tok)
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	tok, err := s.ab.RefreshToken(req.Token, s.opts.Now().UTC())
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	s.writeToken(w, tok)
+}
+
+func (s *Server) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	t, err := s.ab.Verifier().Verify(req.Token, s.opts.Now().UTC())
+	if err != nil {
+		writeJSON(w, http.StatusOK, introspectResponse{Error: err.Error()})
+		return
+	}
+	var notBefore *time.Time
+	if !t.NotBefore.IsZero() {
+		notBefore = &t.NotBefore
+	}
+	writeJSON(w, http.StatusOK, introspectResponse{
+		Active:           true,
+		KeyID:            t.KeyID,
+		TokenID:          t.ID,
+		TenantID:         t.TenantID,
+		OriginalIssuedAt: &t.OriginalIssuedAt,
+		IssuedAt:         &t.IssuedAt,
+		NotBefore:        notBefore,
+		Expiration:       &t.Expiration,
+		Audience:         t.Audience,
+		Capabilities:     t.Capabilities,
+	})
+}
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, struct{}{})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.ab.Keyring().Public())
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	var req revokeRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	now := s.opts.Now().UTC()
+	var err error
+	switch {
+	case req.TokenID != 0 && req.TenantID == 0:
+		err = s.ab.RevokeToken(req.TokenID, now)
+	case req.TenantID != 0 && req.TokenID == 0:
+		err = s.ab.RevokeTenant(req.TenantID, now)
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("exactly one of token_id and tenant_id must be set"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err := s.saveRevocations(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) saveRevocations() error {
+	if s.opts.RevocationsFile == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.ab.Verifier().Revoked.Save(s.opts.RevocationsFile); err != nil {
+		return fmt.Errorf("saving revocations: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) handleRevocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, struct{}{})
+		return
+	}
+	rl := s.ab.Verifier().Revoked
+	if rl == nil {
+		rl = NewRevocationList()
+	}
+	writeJSON(w, http.StatusOK, rl)
+}
@@ -0,0 +1,139 @@
+package authbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testClient struct {
+	t   *testing.T
+	url string
+}
+
+func (c testClient) do(method, path string, req, resp interface{}) int {
+	var body bytes.Buffer
+	if req != nil {
+		require.NoError(c.t, json.NewEncoder(&body).Encode(req))
+	}
+	httpReq, err := http.NewRequest(method, c.url+path, &body)
+	require.NoError(c.t, err)
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	require.NoError(c.t, err)
+	defer httpResp.Body.Close()
+	if resp != nil {
+		require.NoError(c.t, json.NewDecoder(httpResp.Body).Decode(resp))
+	}
+	return httpResp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	now := ts(90)
+	kr := testKeyring(t, 1)
+	srv := httptest.NewServer(NewServer(New(kr, Options{}), ServerOptions{
+		TTL: 10 * time.Second,
+		Now: func() time.Time { return now },
+	}))
+	defer srv.Close()
+	c := testClient{t: t, url: srv.URL}
+
+	var tokResp tokenResponse
+	require.Equal(t, http.StatusOK, c.do("POST", "/token", map[string]interface{}{
+		"tenant_id":    129,
+		"audience":     "sql-proxy",
+		"capabilities": []string{"sql:read"},
+	}, &tokResp))
+	require.Equal(t, ts(100), tokResp.Expiration)
+
+	var intro introspectResponse
+	require.Equal(t, http.StatusOK, c.do("POST", "/introspect", refreshRequest{Token: tokResp.Token}, &intro))
+	require.True(t, intro.Active)
+	require.EqualValues(t, 129, intro.TenantID)
+	require.EqualValues(t, 1, intro.KeyID)
+	require.Equal(t, ts(90), *intro.IssuedAt)
+	require.Equal(t, "sql-proxy", intro.Audience)
+	require.Equal(t, Capabilities{CapabilitySQLRead}, intro.Capabilities)
+
+	// Refresh before expiration.
+	now = ts(98)
+	require.Equal(t, http.StatusOK, c.do("POST", "/refresh", refreshRequest{Token: tokResp.Token}, &tokResp))
+	require.Equal(t, ts(100).Add(Extension), tokResp.Expiration)
+
+	// Refreshing or introspecting an expired token fails.
+	now = ts(200)
+	var errResp struct{ Error string }
+	require.Equal(t, http.StatusUnauthorized, c.do("POST", "/refresh", refreshRequest{Token: tokResp.Token}, &errResp))
+	require.Equal(t, "token is expired", errResp.Error)
+	intro = introspectResponse{}
+	require.Equal(t, http.StatusOK, c.do("POST", "/introspect", refreshRequest{Token: tokResp.Token}, &intro))
+	require.False(t, intro.Active)
+	require.Equal(t, "token is expired", intro.Error)
+
+	// Explicit TTL.
+	require.Equal(t, http.StatusOK, c.do("POST", "/token", map[string]interface{}{
+		"tenant_id": 129,
+		"ttl":       "1m",
+	}, &tokResp))
+	require.Equal(t, ts(260), tokResp.Expiration)
+
+	// Malformed requests.
+	require.Equal(t, http.StatusBadRequest, c.do("POST", "/token", map[string]interface{}{
+		"tenant": 129,
+	}, &errResp))
+	require.Equal(t, http.StatusMethodNotAllowed, c.do("GET", "/token", nil, nil))
+
+	// The published keys verify the token.
+	verifier := NewKeyring()
+	require.Equal(t, http.StatusOK, c.do("GET", "/keys", nil, verifier))
+	_, ok := verifier.Active()
+	require.False(t, ok)
+	require.Len(t, verifier.Keys(), 1)
+	require.Nil(t, verifier.Keys()[0].PrivateKey)
+	tt, err := verifier.Verify(tokResp.Token, now)
+	require.NoError(t, err)
+	require.EqualValues(t, 129, tt.TenantID)
+}
+
+func TestServerRevocation(t *testing.T) {
+	now := ts(90)
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	ab := New(testKeyring(t, 1), Options{Revoked: NewRevocationList()})
+	srv := httptest.NewServer(NewServer(ab, ServerOptions{
+		Now:             func() time.Time { return now },
+		RevocationsFile: path,
+	}))
+	defer srv.Close()
+	c := testClient{t: t, url: srv.URL}
+
+	var tokResp tokenResponse
+	require.Equal(t, http.StatusOK, c.do("POST", "/token", map[string]interface{}{"tenant_id": 5}, &tokResp))
+	var intro introspectResponse
+	require.Equal(t, http.StatusOK, c.do("POST", "/introspect", refreshRequest{Token: tokResp.Token}, &intro))
+	require.True(t, intro.Active)
+
+	var errResp struct{ Error string }
+	require.Equal(t, http.StatusBadRequest, c.do("POST", "/revoke", revokeRequest{}, &errResp))
+	require.Equal(t, http.StatusOK, c.do("POST", "/revoke", revokeRequest{TokenID: intro.TokenID}, nil))
+
+	intro = introspectResponse{}
+	require.Equal(t, http.StatusOK, c.do("POST", "/introspect", refreshRequest{Token: tokResp.Token}, &intro))
+	require.False(t, intro.Active)
+	require.Contains(t, intro.Error, "revoked")
+
+	rl := NewRevocationList()
+	require.Equal(t, http.StatusOK, c.do("GET", "/revocations", nil, rl))
+	tt, err := Decode(tokResp.Token)
+	require.NoError(t, err)
+	require.Error(t, rl.Check(tt))
+
+	// The revocation was saved, so it survives a restart.
+	saved, err := LoadRevocationList(path)
+	require.NoError(t, err)
+	require.Error(t, saved.Check(tt))
+}
@@ -0,0 +1,298 @@
+// Package authbroker mints and verifies signed tokens that identify a tenant.
+// Tokens are handed out by a central broker and verified by the SQL proxy and
+// the KV layer using only the broker's public keys.
+package authbroker
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Version1 is the only token version understood by this package.
+const Version1 = 1
+
+// TextPrefix starts every token. It identifies the text format, see
+// FormatToken.
+const TextPrefix = "abt1."
+
+const (
+	// maxCapabilities and maxStringLen bound the allocations made when
+	// decoding (untrusted) tokens.
+	maxCapabilities = 64
+	maxStringLen    = 255
+)
+
+// Claims are the assertions made by a token.
+type Claims struct {
+	// ID identifies the token. It is preserved by RefreshToken, so that
+	// revoking it also revokes all refreshed descendants.
+	ID       uint64
+	TenantID uint64
+	// OriginalIssuedAt is the IssuedAt of the token that was initially
+	// minted, before any refreshes.
+	OriginalIssuedAt time.Time
+	IssuedAt         time.Time
+	// NotBefore is the time from which the token is valid. If unset, the
+	// token is valid from IssuedAt.
+	NotBefore  time.Time
+	Expiration time.Time
+	// Audience names the service the token is meant for, e.g. "sql-proxy".
+	// A Verifier configured with an audience rejects tokens for any other
+	// audience.
+	Audience     string
+	Capabilities Capabilities
+}
+
+// A Token is a decoded token. The signature is not part of it.
+type Token struct {
+	Version uint8
+	// KeyID identifies the key the token was signed with.
+	KeyID uint32
+	Claims
+}
+
+// The signed message of a token is laid out as
+//
+//	version (1 byte) | key ID | token ID | tenant ID |
+//	original issued at | issued at | not before | expiration |
+//	len(audience) | audience |
+//	#capabilities | (len(capability) | capability)*
+//
+// where all integers except the version are varint-encoded and times are
+// nanoseconds since the Unix epoch, with zero standing for the zero
+// time.Time. The message is signed with Ed25519 (i.e. nacl/sign), and the
+// token is the text form of the message and its detached signature, see
+// FormatToken. Since the signature is detached, the header can be read
+// before the key is known.
+
+// encode returns the signed portion of the token.
+func (t Token) encode() []byte {
+	b := []byte{t.Version}
+	b = binary.AppendUvarint(b, uint64(t.KeyID))
+	b = binary.AppendUvarint(b, t.ID)
+	b = binary.AppendUvarint(b, t.TenantID)
+	b = appendTime(b, t.OriginalIssuedAt)
+	b = appendTime(b, t.IssuedAt)
+	b = appendTime(b, t.NotBefore)
+	b = appendTime(b, t.Expiration)
+	b = appendString(b, t.Audience)
+	b = binary.AppendUvarint(b, uint64(len(t.Capabilities)))
+	for _, c := range t.Capabilities {
+		b = appendString(b, string(c))
+	}
+	return b
+}
+
+func appendTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return binary.AppendVarint(b, 0)
+	}
+	return binary.AppendVarint(b, t.UnixNano())
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// FormatToken returns the text form of a token with the given signed message
+// and detached signature:
+//
+//	abt1.<base64url(message)>.<base64url(signature)>
+//
+// without padding. It contains only URL-safe characters, and so can be passed
+// in HTTP headers, URLs and as a PostgreSQL password.
+func FormatToken(msg, sig []byte) string {
+	enc := base64.RawURLEncoding
+	var sb strings.Builder
+	sb.Grow(len(TextPrefix) + enc.EncodedLen(len(msg)) + 1 + enc.EncodedLen(len(sig)))
+	sb.WriteString(TextPrefix)
+	sb.WriteString(enc.EncodeToString(msg))
+	sb.WriteByte('.')
+	sb.WriteString(enc.EncodeToString(sig))
+	return sb.String()
+}
+
+// ParseToken is the inverse of FormatToken. It does not verify the signature.
+func ParseToken(tok string) (msg, sig []byte, _ error) {
+	if !strings.HasPrefix(tok, TextPrefix) {
+		return nil, nil, errors.New("not a token: missing prefix")
+	}
+	parts := strings.Split(tok[len(TextPrefix):], ".")
+	if len(parts) != 2 {
+		return nil, nil, errors.New("malformed token")
+	}
+	enc := base64.RawURLEncoding.Strict()
+	msg, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed token message: %v", err)
+	}
+	sig, err = enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, nil, errors.New("malformed token signature")
+	}
+	return msg, sig, nil
+}
+
+// Sign returns the token signed with the given private key. The token's
+// KeyID should identify that key.
+func (t Token) Sign(privateKey *[64]byte) (string, error) {
+	if t.Version != Version1 {
+		return "", fmt.Errorf("unsupported token version %d", t.Version)
+	}
+	if len(t.Audience) > maxStringLen {
+		return "", fmt.Errorf("audience too long: %d > %d bytes", len(t.Audience), maxStringLen)
+	}
+	if len(t.Capabilities) > maxCapabilities {
+		return "", fmt.Errorf("too many capabilities: %d > %d", len(t.Capabilities), maxCapabilities)
+	}
+	for _, c := range t.Capabilities {
+		if len(c) > maxStringLen {
+			return "", fmt.Errorf("capability too long: %d > %d bytes", len(c), maxStringLen)
+		}
+	}
+	msg := t.encode()
+	return FormatToken(msg, ed25519.Sign(privateKey[:], msg)), nil
+}
+
+// decoder reads varint-encoded fields, remembering the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint(field string) uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("unable to decode %s", field)
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) time(field string) time.Time {
+	if d.err != nil {
+		return time.Time{}
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("unable to decode %s", field)
+		return time.Time{}
+	}
+	d.b = d.b[n:]
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v).UTC()
+}
+
+func (d *decoder) string(field string) string {
+	l := d.uvarint(field)
+	if d.err != nil {
+		return ""
+	}
+	if l > maxStringLen || l > uint64(len(d.b)) {
+		d.err = fmt.Errorf("unable to decode %s", field)
+		return ""
+	}
+	s := string(d.b[:l])
+	d.b = d.b[l:]
+	return s
+}
+
+// decodeMessage decodes the signed portion of a token.
+func decodeMessage(b []byte) (Token, error) {
+	if len(b) == 0 {
+		return Token{}, errors.New("token is empty")
+	}
+	if b[0] != Version1 {
+		return Token{}, fmt.Errorf("unsupported token version %d", b[0])
+	}
+	d := decoder{b: b[1:]}
+	t := Token{Version: b[0]}
+	keyID := d.uvarint("key ID")
+	if d.err == nil && keyID > 1<<32-1 {
+		d.err = errors.New("key ID out of range")
+	}
+	t.KeyID = uint32(keyID)
+	t.ID = d.uvarint("token ID")
+	t.TenantID = d.uvarint("tenant ID")
+	t.OriginalIssuedAt = d.time("original issued at")
+	t.IssuedAt = d.time("issued at")
+	t.NotBefore = d.time("not before")
+	t.Expiration = d.time("expiration")
+	t.Audience = d.string("audience")
+	numCapabilities := d.uvarint("number of capabilities")
+	if d.err == nil && numCapabilities > maxCapabilities {
+		d.err = fmt.Errorf("too many capabilities: %d > %d", numCapabilities, maxCapabilities)
+	}
+	for i := uint64(0); d.err == nil && i < numCapabilities; i++ {
+		c := d.string("capability")
+		if d.err == nil {
+			t.Capabilities = append(t.Capabilities, Capability(c))
+		}
+	}
+	if d.err != nil {
+		return Token{}, d.err
+	}
+	if len(d.b) != 0 {
+		return Token{}, fmt.Errorf("%d trailing bytes in token", len(d.b))
+	}
+	return t, nil
+}
+
+// Decode decodes a token WITHOUT verifying its signature. The result must not
+// be trusted; use Verify for that.
+func Decode(tok string) (Token, error) {
+	msg, _, err := ParseToken(tok)
+	if err != nil {
+		return Token{}, err
+	}
+	return decodeMessage(msg)
+}
+
+// Verify checks the token's signature against the given public key and that
+// it is valid at the given time, returning the decoded token. Use a Verifier
+// to tolerate clock skew.
+func Verify(tok string, now time.Time, publicKey *[32]byte) (Token, error) {
+	return verify(tok, now, publicKey, 0)
+}
+
+// verify is like Verify, but considers the token valid if it is valid at any
+// time within skew of now.
+func verify(tok string, now time.Time, publicKey *[32]byte, skew time.Duration) (Token, error) {
+	msg, sig, err := ParseToken(tok)
+	if err != nil {
+		return Token{}, err
+	}
+	if !ed25519.Verify(publicKey[:], msg, sig) {
+		return Token{}, errors.New("invalid token")
+	}
+	t, err := decodeMessage(msg)
+	if err != nil {
+		return Token{}, err
+	}
+	if t.Expiration.Before(now.Add(-skew)) {
+		return Token{}, errors.New("token is expired")
+	}
+	notBefore := t.NotBefore
+	if notBefore.IsZero() {
+		notBefore = t.IssuedAt
+	}
+	if now.Add(skew).Before(notBefore) {
+		return Token{}, errors.New("token is not valid yet")
+	}
+	return t, nil
+}
@@ -0,0 +1,181 @@
+package authbroker
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/sign"
+)
+
+func ts(sec int64) time.Time {
+	return time.Unix(sec, 0).UTC()
+}
+
+func testKey(t testing.TB) (*[32]byte, *[64]byte) {
+	publicKey, privateKey, err := sign.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return publicKey, privateKey
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	publicKey, privateKey := testKey(t)
+	exp := Token{
+		Version: Version1,
+		KeyID:   7,
+		Claims: Claims{
+			TenantID:     129,
+			IssuedAt:     ts(90),
+			Expiration:   ts(100),
+			Audience:     "sql-proxy",
+			Capabilities: Capabilities{CapabilitySQLRead, DatabaseCapability("defaultdb")},
+		},
+	}
+	tok, err := exp.Sign(privateKey)
+	require.NoError(t, err)
+
+	act, err := Decode(tok)
+	require.NoError(t, err)
+	require.Equal(t, exp, act)
+
+	act, err = Verify(tok, ts(99), publicKey)
+	require.NoError(t, err)
+	require.Equal(t, exp, act)
+
+	_, err = Verify(tok, ts(101), publicKey)
+	require.EqualError(t, err, "token is expired")
+
+	otherPublicKey, _ := testKey(t)
+	_, err = Verify(tok, ts(99), otherPublicKey)
+	require.EqualError(t, err, "invalid token")
+
+	// Tamper proof.
+	msg, sig, err := ParseToken(tok)
+	require.NoError(t, err)
+	msg[len(msg)-1]++
+	_, err = Verify(FormatToken(msg, sig), ts(99), publicKey)
+	require.EqualError(t, err, "invalid token")
+}
+
+func TestParseToken(t *testing.T) {
+	sig := make([]byte, 64)
+	for _, tc := range []struct {
+		tok    string
+		expErr string
+	}{
+		{tok: FormatToken([]byte("hello"), sig)},
+		{tok: "", expErr: "not a token: missing prefix"},
+		{tok: "abt2.aGVsbG8." + strings.Repeat("A", 86), expErr: "not a token: missing prefix"},
+		{tok: "abt1.aGVsbG8", expErr: "malformed token"},
+		{tok: "abt1.aGVsbG8.x.y", expErr: "malformed token"},
+		{tok: "abt1.aGVsbG8=." + strings.Repeat("A", 86), expErr: "malformed token message: illegal base64 data at input byte 7"},
+		{tok: "abt1.aGVsbG8.AAAA", expErr: "malformed token signature"},
+	} {
+		t.Run(tc.tok, func(t *testing.T) {
+			msg, _, err := ParseToken(tc.tok)
+			if tc.expErr != "" {
+				require.EqualError(t, err, tc.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(msg))
+		})
+	}
+
+	// The text form is URL-safe and needs no quoting in a PostgreSQL
+	// connection string.
+	_, privateKey := testKey(t)
+	tok, err := Token{Version: Version1, Claims: Claims{TenantID: 5}}.Sign(privateKey)
+	require.NoError(t, err)
+	require.Regexp(t, `^abt1\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+$`, tok)
+}
+
+// FuzzTextRoundTrip checks that FormatToken and ParseToken are inverses.
+func FuzzTextRoundTrip(f *testing.F) {
+	f.Add([]byte("hello"), make([]byte, 64))
+	f.Add([]byte{}, []byte{0xff})
+	f.Fuzz(func(t *testing.T, msg, sig []byte) {
+		sig = append(sig, make([]byte, 64)...)[:64]
+		tok := FormatToken(msg, sig)
+		msg2, sig2, err := ParseToken(tok)
+		require.NoError(t, err)
+		require.Equal(t, string(msg), string(msg2))
+		require.Equal(t, sig, sig2)
+	})
+}
+
+// FuzzParseToken checks that every string ParseToken accepts is canonical,
+// i.e. that there is only one text form of each token.
+func FuzzParseToken(f *testing.F) {
+	f.Add(FormatToken([]byte("hello"), make([]byte, 64)))
+	f.Add("abt1..")
+	f.Fuzz(func(t *testing.T, tok string) {
+		msg, sig, err := ParseToken(tok)
+		if err != nil {
+			return
+		}
+		require.Equal(t, tok, FormatToken(msg, sig))
+	})
+}
+
+func TestTokenSignErrors(t *testing.T) {
+	_, privateKey := testKey(t)
+	_, err := Token{Version: 2}.Sign(privateKey)
+	require.EqualError(t, err, "unsupported token version 2")
+
+	_, err = Token{Version: Version1, Claims: Claims{Capabilities: make(Capabilities, maxCapabilities+1)}}.Sign(privateKey)
+	require.EqualError(t, err, "too many capabilities: 65 > 64")
+
+	_, err = Token{Version: Version1, Claims: Claims{Audience: strings.Repeat("x", 256)}}.Sign(privateKey)
+	require.EqualError(t, err, "audience too long: 256 > 255 bytes")
+}
+
+func TestAuthBroker(t *testing.T) {
+	kr := testKeyring(t, 1)
+	ab := New(kr, Options{})
+	k, _ := kr.Active()
+	publicKey := k.PublicKey
+
+	tok, err := ab.MakeToken(Claims{TenantID: 129, IssuedAt: ts(90), Expiration: ts(100)})
+	require.NoError(t, err)
+
+	_, err = ab.RefreshToken(tok, ts(101))
+	require.EqualError(t, err, "token is expired")
+
+	tok, err = ab.RefreshToken(tok, ts(98))
+	require.NoError(t, err)
+
+	tt, err := Verify(tok, ts(105), publicKey)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, tt.KeyID)
+	require.EqualValues(t, 129, tt.TenantID)
+	require.Equal(t, ts(98), tt.IssuedAt)
+	require.Equal(t, ts(100).Add(Extension), tt.Expiration)
+}
+
+func FuzzDecode(f *testing.F) {
+	_, privateKey := testKey(f)
+	for _, tt := range []Token{
+		{Version: Version1},
+		{Version: Version1, KeyID: 1 << 31, Claims: Claims{TenantID: 1<<64 - 1, Expiration: ts(100)}},
+		{Version: Version1, Claims: Claims{IssuedAt: ts(-5), Audience: "kv", Capabilities: Capabilities{"", CapabilityAdmin}}},
+	} {
+		tok, err := tt.Sign(privateKey)
+		require.NoError(f, err)
+		f.Add(tok)
+	}
+	f.Fuzz(func(t *testing.T, tok string) {
+		tt, err := Decode(tok)
+		if err != nil {
+			return
+		}
+		// Whatever decodes must survive a round trip.
+		tok2, err := tt.Sign(privateKey)
+		require.NoError(t, err)
+		tt2, err := Decode(tok2)
+		require.NoError(t, err)
+		require.Equal(t, tt, tt2)
+	})
+}
@@ -0,0 +1,40 @@
+package authbroker
+
+import (
+	"fmt"
+	"time"
+)
+
+// A Verifier verifies tokens against a Keyring and, optionally, a
+// RevocationList and an audience.
+type Verifier struct {
+	Keyring *Keyring
+	Revoked *RevocationList // may be nil
+	// Audience, if set, is the only audience accepted.
+	Audience string
+	// Skew is the amount by which the clocks of the broker and the verifier
+	// may differ. Tokens are accepted if they are valid at any time within
+	// Skew of the verifier's clock.
+	Skew time.Duration
+}
+
+// Verify verifies the token's signature and validity period using the
+// Keyring and rejects it if it has been revoked or is meant for another
+// audience. The returned token's Capabilities tell the caller what to allow.
+//
+// This would be called by the SQL proxy and the KV layer.
+func (v Verifier) Verify(tok string, now time.Time) (Token, error) {
+	t, err := v.Keyring.verify(tok, now, v.Skew)
+	if err != nil {
+		return Token{}, err
+	}
+	if v.Audience != "" && t.Audience != v.Audience {
+		return Token{}, fmt.Errorf("token is for audience %q, not %q", t.Audience, v.Audience)
+	}
+	if v.Revoked != nil {
+		if err := v.Revoked.Check(t); err != nil {
+			return Token{}, err
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,96 @@
+package authbroker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestVerifierSkew(t *testing.T) {
+	const ttl = 10 * time.Second
+
+	// The broker mints a token with the given TTL at its time; the verifier,
+	// whose clock is off by offset, checks it after elapsed time.
+	for _, tc := range []struct {
+		offset    time.Duration // verifier clock minus broker clock
+		skew      time.Duration
+		elapsed   time.Duration
+		notBefore time.Duration // relative to issuance; zero for none
+		expErr    string
+	}{
+		{},
+		// Verifier lags behind: token appears to be from the future.
+		{offset: -time.Second, expErr: "token is not valid yet"},
+		{offset: -time.Second, skew: time.Second},
+		{offset: -2 * time.Second, skew: time.Second, expErr: "token is not valid yet"},
+		{offset: -2 * time.Second, skew: time.Second, elapsed: time.Second},
+		// Verifier is ahead: token appears to expire early.
+		{offset: time.Second, elapsed: ttl - time.Second},
+		{offset: time.Second, elapsed: ttl, expErr: "token is expired"},
+		{offset: time.Second, skew: time.Second, elapsed: ttl},
+		{offset: time.Second, skew: time.Second, elapsed: ttl + time.Nanosecond, expErr: "token is expired"},
+		// Explicit not-before.
+		{notBefore: 5 * time.Second, elapsed: 4 * time.Second, expErr: "token is not valid yet"},
+		{notBefore: 5 * time.Second, elapsed: 5 * time.Second},
+		{notBefore: 5 * time.Second, offset: -time.Second, skew: time.Second, elapsed: 5 * time.Second},
+		{notBefore: 5 * time.Second, offset: -time.Second, elapsed: 5 * time.Second, expErr: "token is not valid yet"},
+	} {
+		t.Run(fmt.Sprintf("offset=%s,skew=%s,elapsed=%s,nbf=%s", tc.offset, tc.skew, tc.elapsed, tc.notBefore), func(t *testing.T) {
+			brokerClock := &fakeClock{now: ts(1000)}
+			ab := New(testKeyring(t, 1), Options{})
+			srv := httptest.NewServer(NewServer(ab, ServerOptions{TTL: ttl, Now: brokerClock.Now}))
+			defer srv.Close()
+			c := testClient{t: t, url: srv.URL}
+
+			req := map[string]interface{}{"tenant_id": 5}
+			if tc.notBefore != 0 {
+				req["not_before"] = brokerClock.Now().Add(tc.notBefore)
+			}
+			var tokResp tokenResponse
+			require.Equal(t, http.StatusOK, c.do("POST", "/token", req, &tokResp))
+
+			brokerClock.Advance(tc.elapsed)
+			verifierClock := &fakeClock{now: brokerClock.Now().Add(tc.offset)}
+			v := Verifier{Keyring: ab.Keyring().Public(), Skew: tc.skew}
+			_, err := v.Verify(tokResp.Token, verifierClock.Now())
+			if tc.expErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expErr)
+			}
+		})
+	}
+}
+
+func TestRefreshSkew(t *testing.T) {
+	clock := &fakeClock{now: ts(1000)}
+	ab := New(testKeyring(t, 1), Options{Skew: 2 * time.Second})
+	tok, err := ab.MakeToken(Claims{TenantID: 5, IssuedAt: clock.Now(), Expiration: clock.Now().Add(time.Second)})
+	require.NoError(t, err)
+
+	// Slightly expired tokens can still be refreshed thanks to the skew
+	// tolerance, but not for long.
+	clock.Advance(3 * time.Second)
+	tok, err = ab.RefreshToken(tok, clock.Now())
+	require.NoError(t, err)
+	clock.Advance(Extension + 3*time.Second)
+	_, err = ab.RefreshToken(tok, clock.Now())
+	require.EqualError(t, err, "token is expired")
+}
@@ -0,0 +1,63 @@
+package crdb2det
+
+// A SelectCase is a branch of a select statement that an actor is blocked
+// on. The states of an actor run until the original code would block in a
+// select statement (or acquiring a mutex), and return its cases, or nil once
+// the actor is done.
+type SelectCase struct {
+	// Name is the name of the state the case transitions to, for example
+	// State0SelectCtxDone.
+	Name string
+	// Ready reports whether the case can proceed. It is nil for the default
+	// case (unless Lock is set), which proceeds only if no other case can.
+	Ready func() bool
+	// Lock, if set, is a mutex the case acquires before running. The case
+	// can only proceed while the mutex is free.
+	Lock TryLocker
+	// Run runs the state the case transitions to.
+	Run func() []SelectCase
+}
+
+func (c *SelectCase) isDefault() bool {
+	return c.Ready == nil && c.Lock == nil
+}
+
+// A TryLocker is a mutex that can be acquired without blocking, like
+// sync.Mutex and Mutex.
+type TryLocker interface {
+	TryLock() bool
+	Unlock()
+}
+
+// A Mutex is a mutual exclusion lock for actors. Blocking in Lock would
+// stall the Scheduler, so actors acquire mutexes through select cases
+// instead (see SelectCase.Lock), which is what actorgen generates for calls
+// to Lock. Lock panics if the mutex is held. The zero value is an unlocked
+// mutex.
+type Mutex struct {
+	locked bool
+}
+
+// Lock locks the mutex, which must not be held.
+func (m *Mutex) Lock() {
+	if !m.TryLock() {
+		panic("crdb2det: Lock of a held Mutex would block the scheduler")
+	}
+}
+
+// TryLock locks the mutex if it is free and reports whether it did.
+func (m *Mutex) TryLock() bool {
+	if m.locked {
+		return false
+	}
+	m.locked = true
+	return true
+}
+
+// Unlock unlocks the mutex, which must be held.
+func (m *Mutex) Unlock() {
+	if !m.locked {
+		panic("crdb2det: Unlock of an unlocked Mutex")
+	}
+	m.locked = false
+}
@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// runtimePath is the import path of the package providing Promise and
+// SelectCase.
+const runtimePath = "github.com/tbg/goplay/crdb2det"
+
+// load parses and type checks the package in dir, including its in-package
+// test files. The file named exclude (typically the previous output of the
+// generator) is skipped. Type checking errors are returned separately, as
+// code using the excluded file doesn't type check.
+func load(
+	dir, exclude string,
+) (*token.FileSet, []*ast.File, *types.Package, *types.Info, []types.Error, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range names {
+		if exclude != "" && filepath.Base(name) == filepath.Base(exclude) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		if len(files) > 0 && f.Name.Name != files[0].Name.Name {
+			// An external test package.
+			continue
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, nil, nil, nil, nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	info := &types.Info{
+		Types:  map[ast.Expr]types.TypeAndValue{},
+		Defs:   map[*ast.Ident]types.Object{},
+		Uses:   map[*ast.Ident]types.Object{},
+		Scopes: map[ast.Node]*types.Scope{},
+	}
+	var typeErrs []types.Error
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(err error) { typeErrs = append(typeErrs, err.(types.Error)) },
+	}
+	pkg, _ := conf.Check(files[0].Name.Name, fset, files, info)
+	return fset, files, pkg, info, typeErrs, nil
+}
+
+// A state is a method of the generated actor. It runs the statements of the
+// original method up to the next select statement, if any.
+type state struct {
+	name string
+	// comm is the communication of the select case leading to this state.
+	comm ast.Stmt
+	// stmts are the statements run by the state, not including the select
+	// statement it ends with.
+	stmts []ast.Stmt
+	// sel is the select statement the state ends with, and cases holds the
+	// states for each of its cases, in order.
+	sel   *ast.SelectStmt
+	cases []*state
+	// lock is the Lock call the state ends with, instead of a select. The
+	// state for the statements following it is the only case.
+	lock *ast.ExprStmt
+	// next is the state to continue with when falling off the end (or
+	// breaking out of a select case), or "" at the end of the method.
+	next string
+	// recv is the field recording which case of sel received a value, by
+	// its number starting at 1, if sel has cases receiving from channels
+	// (other than the Done channel of a context). val and ok are the fields
+	// the value received by the case leading to this state is stashed in,
+	// if the case uses them.
+	recv    string
+	val, ok string
+}
+
+// An edit replaces a range of the source of the method.
+type edit struct {
+	start, end token.Pos
+	text       func() string
+}
+
+type generator struct {
+	fset *token.FileSet
+	info *types.Info
+	pkg  *types.Package
+	file *ast.File
+	src  []byte
+	fn   *ast.FuncDecl
+
+	actor   string // the name of the generated type
+	recv    string // the receiver of the generated methods
+	recvObj types.Object
+	promise string // the field holding the promise
+	// result is the type filled into the promise, and results is the number
+	// of results of the method (0, 1 for error, or 2 for (T, error)).
+	result  string
+	results int
+
+	fieldNames []string
+	fieldTypes map[string]string
+	fields     map[types.Object]string // rewritten into fields of the actor
+	locals     map[types.Object]bool   // all local variables of the method
+	params     []string                // the fields initialized by State0
+
+	imports   map[string]string // path to name
+	states    []*state
+	numStates int
+	edits     []edit
+}
+
+// generate returns the source of an actor type that runs the method of the
+// named type in the package in dir as a state machine.
+//
+// The actor has a field for the receiver and each parameter of the method,
+// for the promise its results are filled into, and for each local variable
+// that is used across states. State0 takes the receiver, the parameters
+// and the promise and starts the actor. Every state returns the cases of the
+// select statement it blocks on, or nil once the promise has been filled.
+// Select statements are only supported at the top level of the method body
+// and of the bodies of select cases. The cases receiving from channels are
+// polled by a non-blocking receive, in order, stashing the first value
+// received (or the zero value if the channel is closed) for the case to
+// consume. A receive case is ready when it received a value, and the other
+// cases of the select are only ready if none did, so that no value is lost:
+// a receive from the Done channel of a context is ready when the context is
+// done, and a send case is ready when the channel has room. In particular,
+// sends on unbuffered channels never proceed, and receives from them only
+// proceed once they are closed.
+//
+// Calls to the Lock method of mutexes (sync.Mutex, crdb2det.Mutex, or any
+// type with TryLock and Unlock methods) at the top level are scheduling
+// points as well: the state returns a single case acquiring the mutex, so
+// that the actor parks instead of blocking the scheduler while the mutex is
+// held. Unlock calls are left as they are.
+func generate(dir, typeName, method, exclude string) ([]byte, error) {
+	fset, files, pkg, info, typeErrs, err := load(dir, exclude)
+	if err != nil {
+		return nil, err
+	}
+	g := &generator{
+		fset:       fset,
+		info:       info,
+		pkg:        pkg,
+		fieldTypes: map[string]string{},
+		fields:     map[types.Object]string{},
+		locals:     map[types.Object]bool{},
+		imports:    map[string]string{},
+		actor:      typeName + method + "Actor",
+	}
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || fn.Name.Name != method || fn.Body == nil {
+				continue
+			}
+			if recvTypeName(fn.Recv.List[0].Type) == typeName {
+				g.fn, g.file = fn, f
+			}
+		}
+	}
+	if g.fn == nil {
+		return nil, fmt.Errorf("method %s.%s not found", typeName, method)
+	}
+	for _, err := range typeErrs {
+		if err.Pos >= g.fn.Pos() && err.Pos < g.fn.End() {
+			return nil, err
+		}
+	}
+	if g.src, err = os.ReadFile(fset.File(g.file.Pos()).Name()); err != nil {
+		return nil, err
+	}
+	if err := g.check(); err != nil {
+		return nil, err
+	}
+	g.declare()
+	g.numStates = 0
+	if _, err := g.split("State0", nil, g.fn.Body.List, ""); err != nil {
+		return nil, err
+	}
+	g.hoist()
+	g.promise = g.addField("p", "")
+	g.stash()
+	g.collectEdits()
+	return g.emit()
+}
+
+func recvTypeName(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if id, ok := expr.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+func (g *generator) errorf(pos token.Pos, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", g.fset.Position(pos), fmt.Sprintf(format, args...))
+}
+
+func (g *generator) text(start, end token.Pos) string {
+	tf := g.fset.File(g.file.Pos())
+	return string(g.src[tf.Offset(start):tf.Offset(end)])
+}
+
+// inspect calls fn for the nodes of the method body, not descending into
+// function literals.
+func inspect(n ast.Node, fn func(ast.Node) bool) {
+	ast.Inspect(n, func(n ast.Node) bool {
+		if _, ok := n.(*ast.FuncLit); ok {
+			return false
+		}
+		return fn(n)
+	})
+}
+
+// check rejects the constructs the generator does not support.
+func (g *generator) check() error {
+	errType := types.Universe.Lookup("error").Type()
+	var results []*ast.Field
+	if g.fn.Type.Results != nil {
+		results = g.fn.Type.Results.List
+	}
+	var n int
+	for _, r := range results {
+		if len(r.Names) > 0 {
+			return g.errorf(r.Pos(), "named results are not supported")
+		}
+		n++
+	}
+	switch {
+	case n == 0:
+		g.result = "struct{}"
+	case n == 1 && types.Identical(g.info.TypeOf(results[0].Type), errType):
+		g.result = "struct{}"
+	case n == 2 && types.Identical(g.info.TypeOf(results[1].Type), errType):
+		g.result = g.text(results[0].Type.Pos(), results[0].Type.End())
+		g.typeImports(g.info.TypeOf(results[0].Type))
+	default:
+		return g.errorf(g.fn.Type.Results.Pos(), "the method must return nothing, an error, or a value and an error")
+	}
+	g.results = n
+
+	var err error
+	inspect(g.fn.Body, func(n ast.Node) bool {
+		if err != nil {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.LabeledStmt:
+			err = g.errorf(n.Pos(), "labels are not supported")
+		case *ast.BranchStmt:
+			if n.Tok == token.GOTO || n.Label != nil {
+				err = g.errorf(n.Pos(), "labels are not supported")
+			}
+		}
+		return err == nil
+	})
+	return err
+}
+
+// declare determines the fields for the receiver, the parameters and the
+// promise, and the name of the receiver of the generated methods.
+func (g *generator) declare() {
+	used := map[string]bool{}
+	ast.Inspect(g.fn, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			used[id.Name] = true
+		}
+		return true
+	})
+	g.recv = "a"
+	for i := 0; used[g.recv]; i++ {
+		g.recv = fmt.Sprintf("a%d", i)
+	}
+
+	var arg int
+	addParam := func(field *ast.Field) {
+		typ := g.text(field.Type.Pos(), field.Type.End())
+		g.typeImports(g.info.TypeOf(field.Type))
+		if len(field.Names) == 0 {
+			name := g.addField(fmt.Sprintf("arg%d", arg), typ)
+			g.params = append(g.params, name)
+			arg++
+		}
+		for _, id := range field.Names {
+			base := id.Name
+			if base == "_" {
+				base = fmt.Sprintf("arg%d", arg)
+			}
+			name := g.addField(base, typ)
+			g.params = append(g.params, name)
+			if obj := g.info.Defs[id]; obj != nil {
+				g.fields[obj] = name
+			}
+			arg++
+		}
+	}
+	recv := g.fn.Recv.List[0]
+	if len(recv.Names) == 0 {
+		recv = &ast.Field{Names: []*ast.Ident{{Name: "recv"}}, Type: recv.Type}
+	} else {
+		g.recvObj = g.info.Defs[recv.Names[0]]
+	}
+	addParam(recv)
+	for _, field := range g.fn.Type.Params.List {
+		addParam(field)
+	}
+
+	// Record the local variables, which are candidates for fields.
+	ast.Inspect(g.fn.Body, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			if v, ok := g.info.Defs[id].(*types.Var); ok && !v.IsField() {
+				g.locals[v] = true
+			}
+		}
+		return true
+	})
+}
+
+// addField adds a field with a name derived from base and returns its name.
+// The promise is added with an empty type, as it is declared separately.
+func (g *generator) addField(base, typ string) string {
+	name := base
+	for i := 0; g.hasField(name); i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	if typ != "" {
+		g.fieldNames = append(g.fieldNames, name)
+		g.fieldTypes[name] = typ
+	}
+	return name
+}
+
+func (g *generator) hasField(name string) bool {
+	_, ok := g.fieldTypes[name]
+	return ok
+}
+
+// stash adds the fields recording which case of a select received a value,
+// and the fields holding the values, see poll.
+func (g *generator) stash() {
+	for _, st := range g.states {
+		if st.sel == nil {
+			continue
+		}
+		for i, cs := range st.cases {
+			comm := st.sel.Body.List[i].(*ast.CommClause).Comm
+			ch := g.recvChan(comm)
+			if ch == nil {
+				continue
+			}
+			if st.recv == "" {
+				st.recv = g.addField("recv", "int")
+			}
+			as, ok := comm.(*ast.AssignStmt)
+			if !ok {
+				continue
+			}
+			base := "recv"
+			if name := []rune(g.exprName(ch)); len(name) > 0 {
+				name[0] = unicode.ToLower(name[0])
+				base = string(name)
+			}
+			elem := g.info.TypeOf(ch).Underlying().(*types.Chan).Elem()
+			g.typeImports(elem)
+			cs.val = g.addField(base+"Val", types.TypeString(elem, g.qualifier))
+			if len(as.Lhs) == 2 {
+				cs.ok = g.addField(base+"OK", "bool")
+			}
+		}
+	}
+}
+
+// recvChan returns the channel the select case receives from, unless it is
+// the Done channel of a context or the case doesn't receive.
+func (g *generator) recvChan(comm ast.Stmt) ast.Expr {
+	var ch ast.Expr
+	switch comm := comm.(type) {
+	case *ast.ExprStmt:
+		ch = comm.X.(*ast.UnaryExpr).X
+	case *ast.AssignStmt:
+		ch = comm.Rhs[0].(*ast.UnaryExpr).X
+	default:
+		return nil
+	}
+	if g.doneContext(ch) != nil {
+		return nil
+	}
+	return ch
+}
+
+// doneContext returns x if the channel is x.Done(), for x of a type with an
+// Err method, like context.Context.
+func (g *generator) doneContext(ch ast.Expr) ast.Expr {
+	call, ok := ch.(*ast.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return nil
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Done" {
+		return nil
+	}
+	if t := g.info.TypeOf(sel.X); t != nil {
+		if obj, _, _ := types.LookupFieldOrMethod(t, true, g.pkg, "Err"); obj != nil {
+			return sel.X
+		}
+	}
+	return nil
+}
+
+// split turns the statements into a state and, for each select statement at
+// the top level, the states of its cases and of the statements following it.
+func (g *generator) split(name string, comm ast.Stmt, stmts []ast.Stmt, next string) (*state, error) {
+	st := &state{name: name, comm: comm, next: next}
+	g.states = append(g.states, st)
+	for i, stmt := range stmts {
+		if locker := g.locker(stmt); locker != nil {
+			st.lock = stmt.(*ast.ExprStmt)
+			cs, err := g.split(name+"Lock"+g.exprName(locker), nil, stmts[i+1:], next)
+			if err != nil {
+				return nil, err
+			}
+			st.cases = append(st.cases, cs)
+			break
+		}
+		sel, ok := stmt.(*ast.SelectStmt)
+		if !ok {
+			st.stmts = append(st.stmts, stmt)
+			continue
+		}
+		st.sel = sel
+		cont := next
+		rest := stmts[i+1:]
+		if len(rest) > 0 {
+			g.numStates++
+			cont = fmt.Sprintf("State%d", g.numStates)
+		}
+		names := map[string]int{}
+		for _, c := range sel.Body.List {
+			cc := c.(*ast.CommClause)
+			caseName := g.caseName(cc)
+			if names[caseName]++; names[caseName] > 1 {
+				caseName += strconv.Itoa(names[caseName])
+			}
+			cs, err := g.split(name+"Select"+caseName, cc.Comm, cc.Body, cont)
+			if err != nil {
+				return nil, err
+			}
+			st.cases = append(st.cases, cs)
+		}
+		if len(rest) > 0 {
+			if _, err := g.split(cont, nil, rest, next); err != nil {
+				return nil, err
+			}
+		}
+		break
+	}
+
+	var err error
+	for _, stmt := range st.stmts {
+		inspect(stmt, func(n ast.Node) bool {
+			if err != nil {
+				return false
+			}
+			switch n := n.(type) {
+			case *ast.SelectStmt:
+				err = g.errorf(n.Pos(), "select statements are only supported at the top level of the "+
+					"method body and of select cases")
+			case *ast.ExprStmt:
+				if g.locker(n) != nil {
+					err = g.errorf(n.Pos(), "Lock calls are only supported at the top level of the "+
+						"method body and of select cases")
+				}
+			case *ast.DeferStmt:
+				if st.sel != nil || st.lock != nil || st.next != "" {
+					err = g.errorf(n.Pos(), "defer is only supported in states that don't block later")
+				}
+			}
+			return err == nil
+		})
+	}
+	return st, err
+}
+
+// caseName returns a name for the case, derived from the channel it
+// operates on.
+func (g *generator) caseName(cc *ast.CommClause) string {
+	var ch ast.Expr
+	var prefix string
+	switch comm := cc.Comm.(type) {
+	case nil:
+		return "Default"
+	case *ast.SendStmt:
+		ch, prefix = comm.Chan, "Send"
+	case *ast.ExprStmt:
+		ch = comm.X.(*ast.UnaryExpr).X
+	case *ast.AssignStmt:
+		ch = comm.Rhs[0].(*ast.UnaryExpr).X
+	}
+	name := g.exprName(ch)
+	if name == "" {
+		name = "Chan"
+	}
+	return prefix + name
+}
+
+// locker returns the receiver of the statement if it is a call to the Lock
+// method of a mutex, that is, of a type which also has TryLock and Unlock
+// methods, like sync.Mutex and crdb2det.Mutex.
+func (g *generator) locker(stmt ast.Stmt) ast.Expr {
+	es, ok := stmt.(*ast.ExprStmt)
+	if !ok {
+		return nil
+	}
+	call, ok := es.X.(*ast.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return nil
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Lock" {
+		return nil
+	}
+	t := g.info.TypeOf(sel.X)
+	if t == nil {
+		return nil
+	}
+	for _, m := range []string{"TryLock", "Unlock"} {
+		if obj, _, _ := types.LookupFieldOrMethod(t, true, g.pkg, m); obj == nil {
+			return nil
+		}
+	}
+	return sel.X
+}
+
+// exprName returns a name derived from the identifiers in the expression,
+// omitting the receiver.
+func (g *generator) exprName(expr ast.Expr) string {
+	var parts []string
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			if obj := g.info.Uses[id]; obj != nil && obj == g.recvObj {
+				return true
+			}
+			r := []rune(id.Name)
+			r[0] = unicode.ToUpper(r[0])
+			parts = append(parts, string(r))
+		}
+		return true
+	})
+	return strings.Join(parts, "")
+}
+
+// hoist turns the local variables used in a state other than the one
+// declaring them into fields.
+func (g *generator) hoist() {
+	defState := map[types.Object]*state{}
+	hoisted := map[types.Object]bool{}
+	for _, st := range g.states {
+		var nodes []ast.Node
+		if st.comm != nil {
+			nodes = append(nodes, st.comm)
+		}
+		for _, stmt := range st.stmts {
+			nodes = append(nodes, stmt)
+		}
+		if st.lock != nil {
+			nodes = append(nodes, st.lock)
+		}
+		for _, n := range nodes {
+			ast.Inspect(n, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					if obj := g.info.Defs[id]; g.locals[obj] {
+						defState[obj] = st
+					}
+				}
+				return true
+			})
+		}
+	}
+	for _, st := range g.states {
+		nodes := []ast.Node{}
+		if st.comm != nil {
+			nodes = append(nodes, st.comm)
+		}
+		for _, stmt := range st.stmts {
+			nodes = append(nodes, stmt)
+		}
+		if st.lock != nil {
+			nodes = append(nodes, st.lock)
+		}
+		for _, n := range nodes {
+			ast.Inspect(n, func(n ast.Node) bool {
+				if id, ok := n.(*ast.Ident); ok {
+					if obj := g.info.Uses[id]; g.locals[obj] && defState[obj] != st {
+						hoisted[obj] = true
+					}
+				}
+				return true
+			})
+		}
+	}
+	// Variables declared by the same statement as a hoisted variable are
+	// hoisted as well, so that the statement can become an assignment.
+	ast.Inspect(g.fn.Body, func(n ast.Node) bool {
+		var defs []types.Object
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if n.Tok != token.DEFINE {
+				return true
+			}
+			for _, lhs := range n.Lhs {
+				if obj := g.info.Defs[lhs.(*ast.Ident)]; obj != nil {
+					defs = append(defs, obj)
+				}
+			}
+		case *ast.ValueSpec:
+			for _, id := range n.Names {
+				if obj := g.info.Defs[id]; obj != nil {
+					defs = append(defs, obj)
+				}
+			}
+		default:
+			return true
+		}
+		var any bool
+		for _, obj := range defs {
+			any = any || hoisted[obj]
+		}
+		if any {
+			for _, obj := range defs {
+				hoisted[obj] = true
+			}
+		}
+		return true
+	})
+	var objs []types.Object
+	for obj := range hoisted {
+		objs = append(objs, obj)
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Pos() < objs[j].Pos() })
+	for _, obj := range objs {
+		g.typeImports(obj.Type())
+		g.fields[obj] = g.addField(obj.Name(), types.TypeString(obj.Type(), g.qualifier))
+	}
+}
+
+func (g *generator) qualifier(p *types.Package) string {
+	if p == g.pkg {
+		return ""
+	}
+	return p.Name()
+}
+
+// typeImports records the imports needed to refer to the type.
+func (g *generator) typeImports(t types.Type) {
+	types.TypeString(t, func(p *types.Package) string {
+		if p != g.pkg {
+			g.imports[p.Path()] = p.Name()
+		}
+		return p.Name()
+	})
+}
+
+// field returns the expression for the field holding obj.
+func (g *generator) field(obj types.Object) string {
+	return g.recv + "." + g.fields[obj]
+}
+
+// collectEdits determines how the source of the method is rewritten.
+func (g *generator) collectEdits() {
+	ast.Inspect(g.fn.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Ident:
+			obj := g.info.Uses[n]
+			if obj == nil {
+				obj = g.info.Defs[n]
+			}
+			if pn, ok := obj.(*types.PkgName); ok {
+				g.imports[pn.Imported().Path()] = pn.Name()
+			}
+			if _, ok := g.fields[obj]; ok {
+				g.edits = append(g.edits, edit{n.Pos(), n.End(), func() string { return g.field(obj) }})
+			}
+		case *ast.AssignStmt:
+			if n.Tok == token.DEFINE {
+				for _, lhs := range n.Lhs {
+					if _, ok := g.fields[g.info.Defs[lhs.(*ast.Ident)]]; ok {
+						g.edits = append(g.edits, edit{n.TokPos, n.TokPos + 2, func() string { return "=" }})
+						break
+					}
+				}
+			}
+		case *ast.DeclStmt:
+			spec := n.Decl.(*ast.GenDecl)
+			if spec.Tok != token.VAR {
+				return true
+			}
+			var hoisted bool
+			for _, s := range spec.Specs {
+				for _, id := range s.(*ast.ValueSpec).Names {
+					_, ok := g.fields[g.info.Defs[id]]
+					hoisted = hoisted || ok
+				}
+			}
+			if !hoisted {
+				return true
+			}
+			// The fields are zero when the declaration runs, as every state
+			// runs at most once.
+			g.edits = append(g.edits, edit{n.Pos(), n.End(), func() string {
+				var lines []string
+				for _, s := range spec.Specs {
+					vs := s.(*ast.ValueSpec)
+					if len(vs.Values) == 0 {
+						continue
+					}
+					var lhs []string
+					for _, id := range vs.Names {
+						if id.Name == "_" {
+							lhs = append(lhs, "_")
+							continue
+						}
+						lhs = append(lhs, g.field(g.info.Defs[id]))
+					}
+					lines = append(lines, strings.Join(lhs, ", ")+" = "+
+						g.rewrite(vs.Values[0].Pos(), vs.Values[len(vs.Values)-1].End()))
+				}
+				return strings.Join(lines, "\n")
+			}})
+		}
+		return true
+	})
+	for _, st := range g.states {
+		st := st
+		for _, stmt := range st.stmts {
+			g.collectControlEdits(st, stmt)
+		}
+		if st.recv == "" {
+			continue
+		}
+		// The receive cases consume the values stashed by Poll.
+		for i, cs := range st.cases {
+			cs := cs
+			switch comm := st.sel.Body.List[i].(*ast.CommClause).Comm.(type) {
+			case *ast.ExprStmt:
+				if g.recvChan(comm) != nil {
+					g.edits = append(g.edits, edit{comm.Pos(), comm.End(), func() string { return "" }})
+				}
+			case *ast.AssignStmt:
+				if g.recvChan(comm) != nil {
+					g.edits = append(g.edits, edit{comm.Rhs[0].Pos(), comm.Rhs[0].End(), func() string {
+						if cs.ok != "" {
+							return g.recv + "." + cs.val + ", " + g.recv + "." + cs.ok
+						}
+						return g.recv + "." + cs.val
+					}})
+				}
+			}
+		}
+	}
+}
+
+// collectControlEdits rewrites the returns of the state into filling the
+// promise, and breaks out of the select case leading to the state into a
+// transition to the next state.
+func (g *generator) collectControlEdits(st *state, stmt ast.Stmt) {
+	var walk func(n ast.Node, inBreakable bool)
+	walk = func(n ast.Node, inBreakable bool) {
+		inspect(n, func(m ast.Node) bool {
+			if m == n {
+				return true
+			}
+			switch m := m.(type) {
+			case *ast.ReturnStmt:
+				g.edits = append(g.edits, edit{m.Pos(), m.End(), func() string {
+					return g.fill(m.Results) + "\nreturn nil"
+				}})
+			case *ast.BranchStmt:
+				// Outside of loops and switches, a break can only refer to the
+				// select statement whose case led to the state.
+				if m.Tok == token.BREAK && !inBreakable {
+					g.edits = append(g.edits, edit{m.Pos(), m.End(), func() string { return g.end(st) }})
+				}
+			case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt:
+				walk(m, true)
+				return false
+			}
+			return true
+		})
+	}
+	walk(&ast.BlockStmt{List: []ast.Stmt{stmt}}, false)
+}
+
+// fill returns the statement filling the promise with the results.
+func (g *generator) fill(results []ast.Expr) string {
+	p := g.recv + "." + g.promise
+	switch {
+	case g.results == 0:
+		return p + ".Fill(struct{}{}, nil)"
+	case g.results == 1:
+		return p + ".Fill(struct{}{}, " + g.rewrite(results[0].Pos(), results[0].End()) + ")"
+	default:
+		return p + ".Fill(" + g.rewrite(results[0].Pos(), results[len(results)-1].End()) + ")"
+	}
+}
+
+// end returns the statements ending the state when it falls off the end.
+func (g *generator) end(st *state) string {
+	if st.next != "" {
+		return "return " + g.recv + "." + st.next + "()"
+	}
+	if g.results == 0 {
+		return g.fill(nil) + "\nreturn nil"
+	}
+	// Unreachable, as the method has results.
+	return "return nil"
+}
+
+// rewrite returns the source of the method between start and end with the
+// edits applied.
+func (g *generator) rewrite(start, end token.Pos) string {
+	var buf strings.Builder
+	pos := start
+	for _, e := range g.edits {
+		if e.start < pos || e.end > end {
+			continue
+		}
+		buf.WriteString(g.text(pos, e.start))
+		buf.WriteString(e.text())
+		pos = e.end
+	}
+	buf.WriteString(g.text(pos, end))
+	return buf.String()
+}
+
+// ready returns the condition under which the i-th case of the select the
+// state ends with can proceed. If the select has cases receiving from
+// channels, they are polled first, see poll.
+func (g *generator) ready(st *state, i int) string {
+	var cond string
+	switch comm := st.sel.Body.List[i].(*ast.CommClause).Comm.(type) {
+	case *ast.SendStmt:
+		c := g.rewrite(comm.Chan.Pos(), comm.Chan.End())
+		cond = "len(" + c + ") < cap(" + c + ")"
+	default:
+		if g.recvChan(comm) != nil {
+			return fmt.Sprintf("%s.%sPoll(%d)", g.recv, st.name, i+1)
+		}
+		var ch ast.Expr
+		if es, ok := comm.(*ast.ExprStmt); ok {
+			ch = es.X.(*ast.UnaryExpr).X
+		} else {
+			ch = comm.(*ast.AssignStmt).Rhs[0].(*ast.UnaryExpr).X
+		}
+		x := g.doneContext(ch)
+		cond = g.rewrite(x.Pos(), x.End()) + ".Err() != nil"
+	}
+	if st.recv != "" {
+		return fmt.Sprintf("%s.%sPoll(0) && %s", g.recv, st.name, cond)
+	}
+	return cond
+}
+
+// poll returns the method polling the cases of the select the state ends
+// with that receive from channels. Poll(i) receives from the channels in
+// order without blocking, until a value is received (or a channel is
+// closed), unless that already happened, and returns whether case i
+// received it, or no case did for 0. The value is stashed for the case to
+// consume once it runs.
+func (g *generator) poll(st *state) string {
+	var buf strings.Builder
+	recv := g.recv + "." + st.recv
+	fmt.Fprintf(&buf, "func (%s *%s) %sPoll(i int) bool {\n", g.recv, g.actor, st.name)
+	for i, cs := range st.cases {
+		comm := st.sel.Body.List[i].(*ast.CommClause).Comm
+		ch := g.recvChan(comm)
+		if ch == nil {
+			continue
+		}
+		lhs := ""
+		switch {
+		case cs.ok != "":
+			lhs = g.recv + "." + cs.val + ", " + g.recv + "." + cs.ok + " = "
+		case cs.val != "":
+			lhs = g.recv + "." + cs.val + " = "
+		}
+		fmt.Fprintf(&buf, "if %s == 0 {\nselect {\ncase %s<-%s:\n%s = %d\ndefault:\n}\n}\n",
+			recv, lhs, g.rewrite(ch.Pos(), ch.End()), recv, i+1)
+	}
+	fmt.Fprintf(&buf, "return %s == i\n}\n", recv)
+	return buf.String()
+}
+
+func (g *generator) emit() ([]byte, error) {
+	sort.SliceStable(g.edits, func(i, j int) bool {
+		if g.edits[i].start != g.edits[j].start {
+			return g.edits[i].start < g.edits[j].start
+		}
+		return g.edits[i].end > g.edits[j].end
+	})
+	qual := ""
+	if g.pkg.Name() != pathName(runtimePath) {
+		g.imports[runtimePath] = "crdb2det"
+		qual = "crdb2det."
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by actorgen from %s. DO NOT EDIT.\n\n",
+		filepath.Base(g.fset.File(g.file.Pos()).Name()))
+	fmt.Fprintf(&buf, "package %s\n\n", g.file.Name.Name)
+	var paths []string
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	// Standard library imports go first.
+	sort.SliceStable(paths, func(i, j int) bool {
+		return !strings.Contains(paths[i], ".") && strings.Contains(paths[j], ".")
+	})
+	fmt.Fprintln(&buf, "import (")
+	for i, path := range paths {
+		if i > 0 && strings.Contains(path, ".") && !strings.Contains(paths[i-1], ".") {
+			fmt.Fprintln(&buf)
+		}
+		name := g.imports[path]
+		if name == pathName(path) {
+			name = ""
+		}
+		fmt.Fprintf(&buf, "%s %q\n", name, path)
+	}
+	fmt.Fprintln(&buf, ")")
+
+	fmt.Fprintf(&buf, "\n// %s runs (%s).%s as a state machine.\n",
+		g.actor, g.text(g.fn.Recv.List[0].Type.Pos(), g.fn.Recv.List[0].Type.End()), g.fn.Name.Name)
+	fmt.Fprintf(&buf, "type %s struct {\n", g.actor)
+	for _, name := range g.fieldNames {
+		fmt.Fprintf(&buf, "%s %s\n", name, g.fieldTypes[name])
+	}
+	fmt.Fprintf(&buf, "%s %sPromise[%s]\n", g.promise, qual, g.result)
+	fmt.Fprintln(&buf, "}")
+
+	for _, st := range g.states {
+		fmt.Fprintln(&buf)
+		if st.name == "State0" {
+			var params, inits []string
+			for _, name := range g.params {
+				params = append(params, name+" "+g.fieldTypes[name])
+				inits = append(inits, name+": "+name)
+			}
+			params = append(params, fmt.Sprintf("%s %sPromise[%s]", g.promise, qual, g.result))
+			inits = append(inits, g.promise+": "+g.promise)
+			fmt.Fprintf(&buf, "func (%s *%s) State0(%s) []%sSelectCase {\n",
+				g.recv, g.actor, strings.Join(params, ", "), qual)
+			fmt.Fprintf(&buf, "*%s = %s{\n%s,\n}\n", g.recv, g.actor, strings.Join(inits, ",\n"))
+		} else {
+			fmt.Fprintf(&buf, "func (%s *%s) %s() []%sSelectCase {\n", g.recv, g.actor, st.name, qual)
+		}
+		if st.comm != nil {
+			if text := g.rewrite(st.comm.Pos(), st.comm.End()); text != "" {
+				fmt.Fprintln(&buf, text)
+			}
+		}
+		for _, stmt := range st.stmts {
+			if text := g.rewrite(stmt.Pos(), stmt.End()); text != "" {
+				fmt.Fprintln(&buf, text)
+			}
+		}
+		switch {
+		case st.lock != nil:
+			locker := g.locker(st.lock)
+			lock := g.rewrite(locker.Pos(), locker.End())
+			if _, ok := g.info.TypeOf(locker).Underlying().(*types.Pointer); !ok {
+				lock = "&" + lock
+			}
+			cs := st.cases[0]
+			fmt.Fprintf(&buf, "return []%sSelectCase{{Name: %q, Lock: %s, Run: %s.%s}}\n",
+				qual, cs.name, lock, g.recv, cs.name)
+		case st.sel != nil:
+			fmt.Fprintf(&buf, "return []%sSelectCase{\n", qual)
+			for i, cs := range st.cases {
+				fmt.Fprintf(&buf, "{Name: %q", cs.name)
+				if st.sel.Body.List[i].(*ast.CommClause).Comm != nil {
+					fmt.Fprintf(&buf, ", Ready: func() bool { return %s }", g.ready(st, i))
+				}
+				fmt.Fprintf(&buf, ", Run: %s.%s},\n", g.recv, cs.name)
+			}
+			fmt.Fprintln(&buf, "}")
+		case len(st.stmts) == 0 || !terminates(st.stmts[len(st.stmts)-1]):
+			fmt.Fprintln(&buf, g.end(st))
+		}
+		fmt.Fprintln(&buf, "}")
+		if st.recv != "" {
+			fmt.Fprintln(&buf)
+			fmt.Fprint(&buf, g.poll(st))
+		}
+	}
+
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %w\n%s", err, buf.Bytes())
+	}
+	return out, nil
+}
+
+func pathName(path string) string {
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// terminates returns whether the statement is terminating, as defined by the
+// Go spec (not considering labels, which are unsupported).
+func terminates(stmt ast.Stmt) bool {
+	switch s := stmt.(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.ExprStmt:
+		if call, ok := s.X.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "panic" {
+				return true
+			}
+		}
+	case *ast.BlockStmt:
+		return len(s.List) > 0 && terminates(s.List[len(s.List)-1])
+	case *ast.IfStmt:
+		return s.Else != nil && terminates(s.Body) && terminates(s.Else)
+	case *ast.ForStmt:
+		return s.Cond == nil && !hasBreak(s.Body)
+	case *ast.SwitchStmt:
+		return clausesTerminate(s.Body)
+	case *ast.TypeSwitchStmt:
+		return clausesTerminate(s.Body)
+	}
+	return false
+}
+
+func clausesTerminate(body *ast.BlockStmt) bool {
+	var hasDefault bool
+	for _, c := range body.List {
+		cc := c.(*ast.CaseClause)
+		hasDefault = hasDefault || cc.List == nil
+		if len(cc.Body) == 0 || hasBreak(&ast.BlockStmt{List: cc.Body}) {
+			return false
+		}
+		last := cc.Body[len(cc.Body)-1]
+		if b, ok := last.(*ast.BranchStmt); ok && b.Tok == token.FALLTHROUGH {
+			continue
+		}
+		if !terminates(last) {
+			return false
+		}
+	}
+	return hasDefault
+}
+
+// hasBreak returns whether the block contains a break statement referring to
+// the enclosing statement.
+func hasBreak(body *ast.BlockStmt) bool {
+	var found bool
+	inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BranchStmt:
+			found = found || n.Tok == token.BREAK
+		case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			return false
+		}
+		return !found
+	})
+	return found
+}
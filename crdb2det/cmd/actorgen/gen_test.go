@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the generated files")
+
+func TestGenerate(t *testing.T) {
+	for _, tc := range []struct {
+		dir, typeName, method, file string
+	}{
+		{"../..", "Server", "Recv", "server_recv_actor_test.go"},
+		{"../..", "Server", "Forward", "server_forward_actor_test.go"},
+		{"testdata/example", "Node", "Relay", "relay_actor.go"},
+		{"testdata/example", "Node", "Notify", "notify_actor.go"},
+		{"testdata/example", "Node", "Transfer", "transfer_actor.go"},
+	} {
+		t.Run(tc.typeName+"."+tc.method, func(t *testing.T) {
+			path := filepath.Join(tc.dir, tc.file)
+			act, err := generate(tc.dir, tc.typeName, tc.method, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				if err := os.WriteFile(path, act, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			exp, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(exp) != string(act) {
+				t.Fatalf("%s is out of date (run go generate or this test with -update); got:\n%s", path, act)
+			}
+		})
+	}
+	// The generated code compiles.
+	_, _, _, _, typeErrs, err := load("testdata/example", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range typeErrs {
+		t.Error(err)
+	}
+}
+
+func TestGenerateUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	src := `package p
+
+import "sync"
+
+type T struct {
+	c  chan int
+	mu sync.Mutex
+}
+
+func (t *T) Loop() {
+	for {
+		select {
+		case <-t.c:
+		}
+	}
+}
+
+func (t *T) Defer() {
+	defer func() {}()
+	select {
+	case <-t.c:
+	}
+}
+
+func (t *T) Named() (n int, err error) {
+	return 0, nil
+}
+
+func (t *T) Results() (int, int) {
+	return 0, 0
+}
+
+func (t *T) Label() {
+L:
+	select {
+	case <-t.c:
+		break L
+	}
+}
+
+func (t *T) NestedLock(b bool) {
+	if b {
+		t.mu.Lock()
+	}
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "p.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for method, exp := range map[string]string{
+		"Loop":    "p.go:12:3: select statements are only supported at the top level of the method body and of select cases",
+		"Defer":   "p.go:19:2: defer is only supported in states that don't block later",
+		"Named":   "p.go:25:22: named results are not supported",
+		"Results": "p.go:29:23: the method must return nothing, an error, or a value and an error",
+		"Label":   "p.go:34:1: labels are not supported",
+		"NestedLock": "p.go:43:3: Lock calls are only supported at the top level of the method body and of " +
+			"select cases",
+		"Missing": "method T.Missing not found",
+	} {
+		_, err := generate(dir, "T", method, "")
+		if err == nil {
+			t.Errorf("%s: expected an error", method)
+			continue
+		}
+		if act := strings.TrimPrefix(err.Error(), dir+"/"); act != exp {
+			t.Errorf("%s: expected %q, got %q", method, exp, act)
+		}
+	}
+}
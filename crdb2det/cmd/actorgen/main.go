@@ -0,0 +1,40 @@
+// Command actorgen generates an actor type that runs a blocking method as a
+// state machine, whose states can be driven one select statement at a time.
+// For example,
+//
+//	actorgen -type Server -method Recv -o server_recv_actor_test.go
+//
+// generates ServerRecvActor from (*Server).Recv in the package in the current
+// directory. Select statements and calls to Lock on mutexes become the
+// points at which the actor yields to the scheduler.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	typeName := flag.String("type", "", "the type the method is declared on")
+	method := flag.String("method", "", "the method to generate an actor for")
+	out := flag.String("o", "", "the output file (default stdout)")
+	dir := flag.String("dir", ".", "the directory of the package")
+	flag.Parse()
+	if *typeName == "" || *method == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	src, err := generate(*dir, *typeName, *method, *out)
+	if err == nil {
+		if *out == "" {
+			_, err = os.Stdout.Write(src)
+		} else {
+			err = os.WriteFile(*out, src, 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+package example
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+type Node struct {
+	in  chan string
+	out chan string
+}
+
+// Relay forwards messages from in to out until it sees "stop".
+func (n *Node) Relay(ctx context.Context, prefix string) (int, error) {
+	var count int
+	var b strings.Builder
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case msg, ok := <-n.in:
+		if !ok {
+			return 0, errors.New("closed")
+		}
+		if msg == "skip" {
+			break
+		}
+		b.WriteString(prefix + msg)
+		count++
+	}
+	select {
+	case n.out <- b.String():
+		return count, nil
+	default:
+		return count, errors.New("full")
+	}
+}
+
+// Notify sends a notification, giving up when the context is done.
+func (n *Node) Notify(ctx context.Context, _ string) error {
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			break
+		}
+	}
+	select {
+	case n.out <- "ping":
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+type Account struct {
+	mu      sync.Mutex
+	balance int
+}
+
+// Transfer moves an amount between accounts, charging a fee.
+func (n *Node) Transfer(from, to *Account, amount int) error {
+	fee := 1
+	from.mu.Lock()
+	ok := from.balance >= amount+fee
+	if ok {
+		from.balance -= amount + fee
+	}
+	from.mu.Unlock()
+	if !ok {
+		return errors.New("insufficient funds")
+	}
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	to.balance += amount
+	return nil
+}
@@ -0,0 +1,51 @@
+// Code generated by actorgen from example.go. DO NOT EDIT.
+
+package example
+
+import (
+	"context"
+
+	"github.com/tbg/goplay/crdb2det"
+)
+
+// NodeNotifyActor runs (*Node).Notify as a state machine.
+type NodeNotifyActor struct {
+	n    *Node
+	ctx  context.Context
+	arg2 string
+	p    crdb2det.Promise[struct{}]
+}
+
+func (a *NodeNotifyActor) State0(n *Node, ctx context.Context, arg2 string, p crdb2det.Promise[struct{}]) []crdb2det.SelectCase {
+	*a = NodeNotifyActor{
+		n:    n,
+		ctx:  ctx,
+		arg2: arg2,
+		p:    p,
+	}
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			break
+		}
+	}
+	return []crdb2det.SelectCase{
+		{Name: "State0SelectSendOut", Ready: func() bool { return len(a.n.out) < cap(a.n.out) }, Run: a.State0SelectSendOut},
+		{Name: "State0SelectCtxDone", Ready: func() bool { return a.ctx.Err() != nil }, Run: a.State0SelectCtxDone},
+	}
+}
+
+func (a *NodeNotifyActor) State0SelectSendOut() []crdb2det.SelectCase {
+	a.n.out <- "ping"
+	return a.State1()
+}
+
+func (a *NodeNotifyActor) State0SelectCtxDone() []crdb2det.SelectCase {
+	<-a.ctx.Done()
+	a.p.Fill(struct{}{}, a.ctx.Err())
+	return nil
+}
+
+func (a *NodeNotifyActor) State1() []crdb2det.SelectCase {
+	a.p.Fill(struct{}{}, nil)
+	return nil
+}
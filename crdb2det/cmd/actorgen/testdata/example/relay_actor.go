@@ -0,0 +1,86 @@
+// Code generated by actorgen from example.go. DO NOT EDIT.
+
+package example
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/tbg/goplay/crdb2det"
+)
+
+// NodeRelayActor runs (*Node).Relay as a state machine.
+type NodeRelayActor struct {
+	n      *Node
+	ctx    context.Context
+	prefix string
+	count  int
+	b      strings.Builder
+	recv   int
+	inVal  string
+	inOK   bool
+	p      crdb2det.Promise[int]
+}
+
+func (a *NodeRelayActor) State0(n *Node, ctx context.Context, prefix string, p crdb2det.Promise[int]) []crdb2det.SelectCase {
+	*a = NodeRelayActor{
+		n:      n,
+		ctx:    ctx,
+		prefix: prefix,
+		p:      p,
+	}
+	return []crdb2det.SelectCase{
+		{Name: "State0SelectCtxDone", Ready: func() bool { return a.State0Poll(0) && a.ctx.Err() != nil }, Run: a.State0SelectCtxDone},
+		{Name: "State0SelectIn", Ready: func() bool { return a.State0Poll(2) }, Run: a.State0SelectIn},
+	}
+}
+
+func (a *NodeRelayActor) State0Poll(i int) bool {
+	if a.recv == 0 {
+		select {
+		case a.inVal, a.inOK = <-a.n.in:
+			a.recv = 2
+		default:
+		}
+	}
+	return a.recv == i
+}
+
+func (a *NodeRelayActor) State0SelectCtxDone() []crdb2det.SelectCase {
+	<-a.ctx.Done()
+	a.p.Fill(0, a.ctx.Err())
+	return nil
+}
+
+func (a *NodeRelayActor) State0SelectIn() []crdb2det.SelectCase {
+	msg, ok := a.inVal, a.inOK
+	if !ok {
+		a.p.Fill(0, errors.New("closed"))
+		return nil
+	}
+	if msg == "skip" {
+		return a.State1()
+	}
+	a.b.WriteString(a.prefix + msg)
+	a.count++
+	return a.State1()
+}
+
+func (a *NodeRelayActor) State1() []crdb2det.SelectCase {
+	return []crdb2det.SelectCase{
+		{Name: "State1SelectSendOut", Ready: func() bool { return len(a.n.out) < cap(a.n.out) }, Run: a.State1SelectSendOut},
+		{Name: "State1SelectDefault", Run: a.State1SelectDefault},
+	}
+}
+
+func (a *NodeRelayActor) State1SelectSendOut() []crdb2det.SelectCase {
+	a.n.out <- a.b.String()
+	a.p.Fill(a.count, nil)
+	return nil
+}
+
+func (a *NodeRelayActor) State1SelectDefault() []crdb2det.SelectCase {
+	a.p.Fill(a.count, errors.New("full"))
+	return nil
+}
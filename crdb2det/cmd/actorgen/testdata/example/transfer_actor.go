@@ -0,0 +1,51 @@
+// Code generated by actorgen from example.go. DO NOT EDIT.
+
+package example
+
+import (
+	"errors"
+
+	"github.com/tbg/goplay/crdb2det"
+)
+
+// NodeTransferActor runs (*Node).Transfer as a state machine.
+type NodeTransferActor struct {
+	n      *Node
+	from   *Account
+	to     *Account
+	amount int
+	fee    int
+	p      crdb2det.Promise[struct{}]
+}
+
+func (a *NodeTransferActor) State0(n *Node, from *Account, to *Account, amount int, p crdb2det.Promise[struct{}]) []crdb2det.SelectCase {
+	*a = NodeTransferActor{
+		n:      n,
+		from:   from,
+		to:     to,
+		amount: amount,
+		p:      p,
+	}
+	a.fee = 1
+	return []crdb2det.SelectCase{{Name: "State0LockFromMu", Lock: &a.from.mu, Run: a.State0LockFromMu}}
+}
+
+func (a *NodeTransferActor) State0LockFromMu() []crdb2det.SelectCase {
+	ok := a.from.balance >= a.amount+a.fee
+	if ok {
+		a.from.balance -= a.amount + a.fee
+	}
+	a.from.mu.Unlock()
+	if !ok {
+		a.p.Fill(struct{}{}, errors.New("insufficient funds"))
+		return nil
+	}
+	return []crdb2det.SelectCase{{Name: "State0LockFromMuLockToMu", Lock: &a.to.mu, Run: a.State0LockFromMuLockToMu}}
+}
+
+func (a *NodeTransferActor) State0LockFromMuLockToMu() []crdb2det.SelectCase {
+	defer a.to.mu.Unlock()
+	a.to.balance += a.amount
+	a.p.Fill(struct{}{}, nil)
+	return nil
+}
@@ -0,0 +1,337 @@
+package crdb2det
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotDone is returned by Future.Result for a future that isn't done.
+var ErrNotDone = errors.New("future is not done")
+
+type future[T any] struct {
+	done      bool
+	v         T
+	err       error
+	callbacks []func(T, error)
+}
+
+// A Promise is the write side of a result that becomes available later, read
+// through the corresponding Future. Promises and futures are not safe for
+// concurrent use; they are meant to be used by actors on a Scheduler.
+type Promise[T any] struct {
+	f *future[T]
+}
+
+// A Future is the read side of a result that becomes available later.
+type Future[T any] struct {
+	f *future[T]
+}
+
+// NewPromise returns a promise and the future it completes.
+func NewPromise[T any]() (Promise[T], Future[T]) {
+	f := &future[T]{}
+	return Promise[T]{f}, Future[T]{f}
+}
+
+// Fill completes the future with the result, running its callbacks. It
+// panics if the promise was already filled.
+func (p Promise[T]) Fill(v T, err error) {
+	if !p.TryFill(v, err) {
+		panic(fmt.Sprintf("promise filled twice (with %v, %v)", v, err))
+	}
+}
+
+// TryFill is like Fill, but returns false instead of panicking if the promise
+// was already filled, for promises that are raced to be filled.
+func (p Promise[T]) TryFill(v T, err error) bool {
+	f := p.f
+	if f.done {
+		return false
+	}
+	f.done, f.v, f.err = true, v, err
+	callbacks := f.callbacks
+	f.callbacks = nil
+	for _, cb := range callbacks {
+		cb(v, err)
+	}
+	return true
+}
+
+// Future returns the future completed by the promise.
+func (p Promise[T]) Future() Future[T] {
+	return Future[T]{p.f}
+}
+
+// Done returns whether the future is complete.
+func (f Future[T]) Done() bool {
+	return f.f.done
+}
+
+// Result returns the result of the future, or ErrNotDone.
+func (f Future[T]) Result() (T, error) {
+	if !f.f.done {
+		var zero T
+		return zero, ErrNotDone
+	}
+	return f.f.v, f.f.err
+}
+
+// OnDone arranges for cb to be called with the result once the future is
+// complete, which is right away if it already is. Callbacks run in the order
+// in which they were added.
+func (f Future[T]) OnDone(cb func(T, error)) {
+	if f.f.done {
+		cb(f.f.v, f.f.err)
+		return
+	}
+	f.f.callbacks = append(f.f.callbacks, cb)
+}
+
+// Case returns a select case for an actor, which is ready once the future is
+// complete and runs fn with the result.
+func (f Future[T]) Case(name string, fn func(T, error) []SelectCase) SelectCase {
+	return SelectCase{
+		Name:  name,
+		Ready: f.Done,
+		Run:   func() []SelectCase { return fn(f.f.v, f.f.err) },
+	}
+}
+
+// Then returns a future completed with the result of fn, applied to the
+// result of f once it is complete.
+func Then[T, U any](f Future[T], fn func(T, error) (U, error)) Future[U] {
+	p, res := NewPromise[U]()
+	f.OnDone(func(v T, err error) { p.Fill(fn(v, err)) })
+	return res
+}
+
+// All returns a future completed with the results of the futures, in order,
+// once all of them succeeded, or with the first error, as soon as one of them
+// fails.
+func All[T any](fs ...Future[T]) Future[[]T] {
+	p, res := NewPromise[[]T]()
+	vs := make([]T, len(fs))
+	remaining := len(fs)
+	if remaining == 0 {
+		p.Fill(vs, nil)
+	}
+	for i, f := range fs {
+		i := i
+		f.OnDone(func(v T, err error) {
+			if err != nil {
+				p.TryFill(nil, err)
+				return
+			}
+			vs[i] = v
+			if remaining--; remaining == 0 {
+				p.TryFill(vs, nil)
+			}
+		})
+	}
+	return res
+}
+
+// Any returns a future completed with the result of the first of the futures
+// to succeed, or with the errors of all of them (joined in order) if they all
+// fail.
+func Any[T any](fs ...Future[T]) Future[T] {
+	p, res := NewPromise[T]()
+	errs := make([]error, len(fs))
+	remaining := len(fs)
+	if remaining == 0 {
+		var zero T
+		p.Fill(zero, errors.New("no futures"))
+	}
+	for i, f := range fs {
+		i := i
+		f.OnDone(func(v T, err error) {
+			if err == nil {
+				p.TryFill(v, nil)
+				return
+			}
+			errs[i] = err
+			if remaining--; remaining == 0 {
+				var zero T
+				p.TryFill(zero, errors.Join(errs...))
+			}
+		})
+	}
+	return res
+}
+
+// A TimeoutError is the error of a future that timed out.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.Timeout)
+}
+
+// Is makes TimeoutErrors match context.DeadlineExceeded.
+func (e *TimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// WithTimeout returns a future that completes like f, or fails with a
+// *TimeoutError once the virtual clock of the scheduler advanced by d,
+// whichever happens first.
+func WithTimeout[T any](s *Scheduler, f Future[T], d time.Duration) Future[T] {
+	p, res := NewPromise[T]()
+	t := s.AfterFunc(d, func() {
+		var zero T
+		p.TryFill(zero, &TimeoutError{Timeout: d})
+	})
+	f.OnDone(func(v T, err error) {
+		t.Stop()
+		p.TryFill(v, err)
+	})
+	return res
+}
+
+// WithContext returns a future that completes like f, or fails with the error
+// of the context once it is done, whichever happens first. The context is
+// observed by an actor on the scheduler, so this is deterministic as long as
+// the context is canceled by actors or timers of the scheduler, for example
+// through Scheduler.WithTimeout.
+func WithContext[T any](s *Scheduler, ctx context.Context, f Future[T]) Future[T] {
+	p, res := NewPromise[T]()
+	f.OnDone(func(v T, err error) { p.TryFill(v, err) })
+	s.Spawn("context", func() []SelectCase {
+		return []SelectCase{
+			res.Case("done", func(T, error) []SelectCase { return nil }),
+			{Name: "canceled", Ready: func() bool { return ctx.Err() != nil }, Run: func() []SelectCase {
+				var zero T
+				p.TryFill(zero, ctx.Err())
+				return nil
+			}},
+		}
+	})
+	return res
+}
+
+// ToContext returns a context that is canceled once the future is complete,
+// with the error of the future as the cause, if any.
+func ToContext[T any](parent context.Context, f Future[T]) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	f.OnDone(func(_ T, err error) { cancel(err) })
+	return ctx, func() { cancel(nil) }
+}
+
+// timeoutCtx is the context returned by Scheduler.WithTimeout. Rather than
+// wrapping a context of the context package, which would cancel the contexts
+// derived from it with context.Canceled, it implements the AfterFunc method
+// through which the context package propagates cancellation, so that derived
+// contexts report its error, like those of context.WithTimeout.
+type timeoutCtx struct {
+	context.Context // the parent
+	deadline        time.Time
+
+	mu   sync.Mutex
+	done chan struct{}
+	err  error
+	fns  map[int]func() // by the order of registration
+	seq  int
+}
+
+func (c *timeoutCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *timeoutCtx) Done() <-chan struct{} {
+	c.checkParent()
+	return c.done
+}
+
+func (c *timeoutCtx) Err() error {
+	c.checkParent()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// AfterFunc arranges for fn to run once the context is done, like
+// context.AfterFunc, except that fn runs synchronously.
+func (c *timeoutCtx) AfterFunc(fn func()) (stop func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		// The context package calls this with its mutexes held.
+		go fn()
+		return func() bool { return false }
+	}
+	id := c.seq
+	c.seq++
+	c.fns[id] = fn
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_, ok := c.fns[id]
+		delete(c.fns, id)
+		return ok
+	}
+}
+
+// checkParent cancels the context if its parent is done. The context package
+// doesn't notify other implementations synchronously, so this is called by
+// Done and Err, and by the scheduler before every step for the contexts
+// derived from this one.
+func (c *timeoutCtx) checkParent() {
+	if err := c.Context.Err(); err != nil {
+		c.cancel(err)
+	}
+}
+
+// cancel makes the context done with the error, unless it already is.
+func (c *timeoutCtx) cancel(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	var ids []int
+	for id := range c.fns {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	fns := c.fns
+	c.fns = nil
+	c.mu.Unlock()
+	for _, id := range ids {
+		fns[id]()
+	}
+}
+
+// WithTimeout is like context.WithTimeout, but the context expires once the
+// virtual clock of the scheduler advanced by d. The contexts derived from it
+// report context.DeadlineExceeded once it expires as well. The cancellation
+// of the parent is propagated to them before the next step of the scheduler
+// (or once Done or Err of the returned context is called), rather than right
+// away.
+func (s *Scheduler) WithTimeout(
+	parent context.Context, d time.Duration,
+) (context.Context, context.CancelFunc) {
+	ctx := &timeoutCtx{
+		Context:  parent,
+		deadline: s.Now().Add(d),
+		done:     make(chan struct{}),
+		fns:      map[int]func(){},
+	}
+	if parent.Done() != nil {
+		s.contexts = append(s.contexts, ctx)
+	}
+	t := s.AfterFunc(d, func() {
+		ctx.checkParent()
+		ctx.cancel(context.DeadlineExceeded)
+	})
+	return ctx, func() {
+		t.Stop()
+		ctx.cancel(context.Canceled)
+	}
+}
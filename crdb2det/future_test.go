@@ -0,0 +1,215 @@
+package crdb2det
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromise(t *testing.T) {
+	p, f := NewPromise[int]()
+	if f.Done() {
+		t.Fatal("unexpectedly done")
+	}
+	if _, err := f.Result(); err != ErrNotDone {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var calls []string
+	f.OnDone(func(v int, err error) { calls = append(calls, fmt.Sprintf("first %d %v", v, err)) })
+	f.OnDone(func(v int, err error) { calls = append(calls, fmt.Sprintf("second %d %v", v, err)) })
+	p.Fill(1, nil)
+	f.OnDone(func(v int, err error) { calls = append(calls, fmt.Sprintf("late %d %v", v, err)) })
+	if exp, act := "first 1 <nil>, second 1 <nil>, late 1 <nil>", strings.Join(calls, ", "); exp != act {
+		t.Fatalf("expected %s, got %s", exp, act)
+	}
+	if v, err := p.Future().Result(); v != 1 || err != nil {
+		t.Fatalf("unexpected result: %d %v", v, err)
+	}
+
+	if p.TryFill(2, nil) {
+		t.Fatal("promise filled twice")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil || r != "promise filled twice (with 2, <nil>)" {
+				t.Fatalf("unexpected panic: %v", r)
+			}
+		}()
+		p.Fill(2, nil)
+	}()
+}
+
+func TestThen(t *testing.T) {
+	p, f := NewPromise[int]()
+	g := Then(f, func(v int, err error) (string, error) {
+		if err != nil {
+			return "", fmt.Errorf("wrapped: %w", err)
+		}
+		return fmt.Sprint(v * 2), nil
+	})
+	p.Fill(21, nil)
+	if v, err := g.Result(); v != "42" || err != nil {
+		t.Fatalf("unexpected result: %s %v", v, err)
+	}
+}
+
+func TestAll(t *testing.T) {
+	p1, f1 := NewPromise[int]()
+	p2, f2 := NewPromise[int]()
+	all := All(f1, f2)
+	p2.Fill(2, nil)
+	if all.Done() {
+		t.Fatal("unexpectedly done")
+	}
+	p1.Fill(1, nil)
+	if vs, err := all.Result(); err != nil || fmt.Sprint(vs) != "[1 2]" {
+		t.Fatalf("unexpected result: %v %v", vs, err)
+	}
+
+	// The first error fails All right away.
+	p1, f1 = NewPromise[int]()
+	p2, f2 = NewPromise[int]()
+	all = All(f1, f2)
+	errBoom := errors.New("boom")
+	p2.Fill(0, errBoom)
+	if _, err := all.Result(); err != errBoom {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p1.Fill(0, errors.New("ignored"))
+
+	if vs, err := All[int]().Result(); err != nil || len(vs) != 0 {
+		t.Fatalf("unexpected result: %v %v", vs, err)
+	}
+}
+
+func TestAny(t *testing.T) {
+	p1, f1 := NewPromise[int]()
+	p2, f2 := NewPromise[int]()
+	first := Any(f1, f2)
+	p1.Fill(0, errors.New("one"))
+	if first.Done() {
+		t.Fatal("unexpectedly done")
+	}
+	p2.Fill(2, nil)
+	if v, err := first.Result(); v != 2 || err != nil {
+		t.Fatalf("unexpected result: %d %v", v, err)
+	}
+
+	p1, f1 = NewPromise[int]()
+	p2, f2 = NewPromise[int]()
+	first = Any(f1, f2)
+	p2.Fill(0, errors.New("two"))
+	p1.Fill(0, errors.New("one"))
+	if _, err := first.Result(); err == nil || err.Error() != "one\ntwo" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := Any[int]().Result(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	s := NewScheduler(0)
+	p1, f1 := NewPromise[int]()
+	p2, f2 := NewPromise[int]()
+	t1 := WithTimeout(s, f1, time.Second)
+	t2 := WithTimeout(s, f2, time.Second)
+	s.AfterFunc(500*time.Millisecond, func() { p1.Fill(1, nil) })
+	s.AfterFunc(2*time.Second, func() { p2.Fill(2, nil) })
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := t1.Result(); v != 1 || err != nil {
+		t.Fatalf("unexpected result: %d %v", v, err)
+	}
+	_, err := t2.Result()
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) ||
+		err.Error() != "timed out after 1s" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The timer of the first future was stopped.
+	if exp, act := "500ms timer, 1s timer, 2s timer", strings.Join(s.Trace(), ", "); exp != act {
+		t.Fatalf("expected %s, got %s", exp, act)
+	}
+}
+
+func TestContextBridge(t *testing.T) {
+	s := NewScheduler(0)
+	ctx, cancel := s.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if d, ok := ctx.Deadline(); !ok || !d.Equal(Epoch.Add(time.Second)) {
+		t.Fatalf("unexpected deadline: %s", d)
+	}
+	p1, f1 := NewPromise[int]()
+	_, f2 := NewPromise[int]()
+	w1 := WithContext(s, ctx, f1)
+	w2 := WithContext(s, ctx, f2)
+	s.AfterFunc(500*time.Millisecond, func() { p1.Fill(1, nil) })
+	var expiredAt time.Duration
+	s.Spawn("waiter", func() []SelectCase {
+		return []SelectCase{w2.Case("w2", func(_ int, err error) []SelectCase {
+			expiredAt = s.Now().Sub(Epoch)
+			return nil
+		})}
+	})
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := w1.Result(); v != 1 || err != nil {
+		t.Fatalf("unexpected result: %d %v", v, err)
+	}
+	if _, err := w2.Result(); err != context.DeadlineExceeded || expiredAt != time.Second {
+		t.Fatalf("unexpected result: %v at %s", err, expiredAt)
+	}
+
+	// Derived contexts expire as well, and report the same error.
+	ctx, cancel = s.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	derived, dcancel := context.WithCancel(ctx)
+	defer dcancel()
+	s.Spawn("waiter", func() []SelectCase {
+		return []SelectCase{{Name: "derived", Ready: func() bool { return derived.Err() != nil }, Run: func() []SelectCase {
+			expiredAt = s.Now().Sub(Epoch)
+			return nil
+		}}}
+	})
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := derived.Err(); err != context.DeadlineExceeded || expiredAt != 2*time.Second {
+		t.Fatalf("unexpected result: %v at %s", err, expiredAt)
+	}
+	if err := context.Cause(derived); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected cause: %v", err)
+	}
+
+	// The cancellation of the parent is propagated before the next step.
+	parent, pcancel := context.WithCancelCause(context.Background())
+	ctx, cancel = s.WithTimeout(parent, time.Second)
+	defer cancel()
+	derived, dcancel = context.WithCancel(ctx)
+	defer dcancel()
+	errStop := errors.New("stop")
+	pcancel(errStop)
+	if !s.Step() {
+		t.Fatal("expected the timer to fire")
+	}
+	if derived.Err() != context.Canceled || context.Cause(derived) != errStop {
+		t.Fatalf("unexpected context error: %v (%v)", derived.Err(), context.Cause(derived))
+	}
+
+	// A context canceled by a future carries its error.
+	p, f := NewPromise[int]()
+	fctx, fcancel := ToContext(context.Background(), f)
+	defer fcancel()
+	errBoom := errors.New("boom")
+	p.Fill(0, errBoom)
+	if fctx.Err() != context.Canceled || context.Cause(fctx) != errBoom {
+		t.Fatalf("unexpected context error: %v (%v)", fctx.Err(), context.Cause(fctx))
+	}
+}
@@ -1 +1,4 @@
 package crdb2det
+
+//go:generate go run ./cmd/actorgen -type Server -method Recv -o server_recv_actor_test.go
+//go:generate go run ./cmd/actorgen -type Server -method Forward -o server_forward_actor_test.go
@@ -2,34 +2,68 @@ package crdb2det
 
 import (
 	"context"
-	"fmt"
+	"testing"
 )
 
-type Promise[T any] interface {
-	Fill(T, error)
+// runActor runs the actor from the given start state to completion.
+func runActor(t *testing.T, start func() []SelectCase) {
+	t.Helper()
+	s := NewScheduler(0)
+	s.Spawn("actor", start)
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
 }
 
-type ServerReqActor struct {
-	s *Server
-	r Req
-	p Promise[Resp]
-}
+func TestServerRecvActor(t *testing.T) {
+	var s Server
+	var a ServerRecvActor
+	p, f := NewPromise[Resp]()
+	runActor(t, func() []SelectCase { return a.State0(&s, context.Background(), "foo", p) })
+	if v, err := f.Result(); err != nil || v != "hello back, foo (seq #1)" {
+		t.Fatalf("unexpected result: %v %v", v, err)
+	}
 
-func (a *ServerReqActor) State0(s *Server, r Req, p Promise[Resp]) {
-	*a = ServerReqActor{
-		s: s,
-		r: r,
-		p: p,
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p, f = NewPromise[Resp]()
+	runActor(t, func() []SelectCase { return a.State0(&s, ctx, "foo", p) })
+	if _, err := f.Result(); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
 	}
 }
 
-func (a *ServerReqActor) State0SelectCtxDone(ctx context.Context) {
-	a.p.Fill("", ctx.Err())
-}
+func TestServerForwardActor(t *testing.T) {
+	var s Server
+	var a ServerForwardActor
+	forward := func(ctx context.Context, in <-chan Req) (Resp, error) {
+		p, f := NewPromise[Resp]()
+		runActor(t, func() []SelectCase { return a.State0(&s, ctx, in, p) })
+		return f.Result()
+	}
 
-func (a *ServerReqActor) State0SelectDefault() {
-	a.s.mu.Lock()
-	a.s.mu.seq++
-	defer a.s.mu.Unlock()
-	a.p.Fill(Resp(fmt.Sprintf("hello back, %s (seq #%d)", a.r, a.s.mu.seq)), nil)
+	// A buffered value is received.
+	in := make(chan Req, 1)
+	in <- "foo"
+	if v, err := forward(context.Background(), in); err != nil || v != "hello back, foo (seq #1)" {
+		t.Fatalf("unexpected result: %v %v", v, err)
+	}
+
+	// A closed channel, even unbuffered, is ready.
+	unbuffered := make(chan Req)
+	close(unbuffered)
+	if _, err := forward(context.Background(), unbuffered); err == nil || err.Error() != "closed" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A value received while polling isn't lost to another case.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	in <- "bar"
+	if v, err := forward(ctx, in); err != context.Canceled || v != "" {
+		t.Fatalf("unexpected result: %v %v", v, err)
+	}
+	if len(in) != 0 {
+		t.Fatal("value was not received")
+	}
 }
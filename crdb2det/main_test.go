@@ -2,6 +2,7 @@ package crdb2det
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 )
@@ -28,3 +29,15 @@ func (s *Server) Recv(ctx context.Context, req Req) (Resp, error) {
 		return Resp(fmt.Sprintf("hello back, %s (seq #%d)", req, s.mu.seq)), nil
 	}
 }
+
+func (s *Server) Forward(ctx context.Context, in <-chan Req) (Resp, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case req, ok := <-in:
+		if !ok {
+			return "", errors.New("closed")
+		}
+		return s.Recv(ctx, req)
+	}
+}
@@ -0,0 +1,143 @@
+package crdb2det
+
+import (
+	"fmt"
+	"time"
+)
+
+// An Addr identifies a node on a Network.
+type Addr string
+
+// A Handler serves a request of type Q delivered to a node, filling the
+// promise with the response of type R. It returns the cases of the select it
+// blocks on, like the states of a generated actor, for example
+//
+//	func(req Req, p Promise[Resp]) []SelectCase {
+//		var a ServerRecvActor
+//		return a.State0(srv, ctx, req, p)
+//	}
+type Handler[Q, R any] func(req Q, p Promise[R]) []SelectCase
+
+// Faults configures the faults injected by a Network.
+type Faults struct {
+	// Messages are delayed by a duration chosen uniformly from [MinDelay,
+	// MaxDelay], which reorders them.
+	MinDelay, MaxDelay time.Duration
+	// DropRate is the probability of a message being dropped.
+	DropRate float64
+	// DuplicateRate is the probability of a message being delivered twice.
+	DuplicateRate float64
+}
+
+// NetworkStats counts the messages of a Network. Requests and responses are
+// counted separately.
+type NetworkStats struct {
+	Sent, Dropped, Duplicated int
+}
+
+// A Network delivers requests to the handlers of nodes and their responses
+// back, injecting faults as configured. All choices are made by the
+// scheduler, so that they are reproduced by its seed. Delivery is unreliable:
+// the future returned by Send may never complete, so callers typically use
+// WithTimeout and retry.
+type Network[Q, R any] struct {
+	s           *Scheduler
+	faults      Faults
+	handlers    map[Addr]Handler[Q, R]
+	partitioned map[[2]Addr]bool
+	stats       NetworkStats
+}
+
+// NewNetwork returns a network on the scheduler.
+func NewNetwork[Q, R any](s *Scheduler, faults Faults) *Network[Q, R] {
+	return &Network[Q, R]{
+		s:           s,
+		faults:      faults,
+		handlers:    map[Addr]Handler[Q, R]{},
+		partitioned: map[[2]Addr]bool{},
+	}
+}
+
+// Listen registers the handler of the node.
+func (n *Network[Q, R]) Listen(addr Addr, h Handler[Q, R]) {
+	n.handlers[addr] = h
+}
+
+func pair(a, b Addr) [2]Addr {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]Addr{a, b}
+}
+
+// Partition drops the messages between the nodes, including those already in
+// flight, until Heal is called.
+func (n *Network[Q, R]) Partition(a, b Addr) {
+	n.partitioned[pair(a, b)] = true
+}
+
+// Heal undoes Partition.
+func (n *Network[Q, R]) Heal(a, b Addr) {
+	delete(n.partitioned, pair(a, b))
+}
+
+// Stats returns the number of messages sent, dropped and duplicated so far.
+func (n *Network[Q, R]) Stats() NetworkStats {
+	return n.stats
+}
+
+// Send sends the request to the node, whose handler is run by an actor on
+// the scheduler once the request is delivered. The returned future completes
+// once the first response is delivered back, if ever.
+func (n *Network[Q, R]) Send(from, to Addr, req Q) Future[R] {
+	p, f := NewPromise[R]()
+	n.deliver(from, to, func() {
+		h := n.handlers[to]
+		if h == nil {
+			return
+		}
+		rp, rf := NewPromise[R]()
+		rf.OnDone(func(resp R, err error) {
+			n.deliver(to, from, func() { p.TryFill(resp, err) })
+		})
+		n.s.Spawn(fmt.Sprintf("%s: %v from %s", to, req, from), func() []SelectCase {
+			return h(req, rp)
+		})
+	})
+	return f
+}
+
+// deliver runs fn once the message from one node to another is delivered.
+func (n *Network[Q, R]) deliver(from, to Addr, fn func()) {
+	n.stats.Sent++
+	if n.chance(n.faults.DropRate) {
+		n.stats.Dropped++
+		return
+	}
+	copies := 1
+	if n.chance(n.faults.DuplicateRate) {
+		n.stats.Duplicated++
+		copies++
+	}
+	for i := 0; i < copies; i++ {
+		n.s.AfterFunc(n.delay(), func() {
+			if n.partitioned[pair(from, to)] {
+				n.stats.Dropped++
+				return
+			}
+			fn()
+		})
+	}
+}
+
+func (n *Network[Q, R]) chance(p float64) bool {
+	return p > 0 && n.s.Float64() < p
+}
+
+func (n *Network[Q, R]) delay() time.Duration {
+	d := n.faults.MinDelay
+	if spread := n.faults.MaxDelay - n.faults.MinDelay; spread > 0 {
+		d += time.Duration(n.s.Int63n(int64(spread) + 1))
+	}
+	return d
+}
@@ -0,0 +1,194 @@
+package crdb2det
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serverHandler(srv *Server) Handler[Req, Resp] {
+	return func(req Req, p Promise[Resp]) []SelectCase {
+		var a ServerRecvActor
+		return a.State0(srv, context.Background(), req, p)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	s := NewScheduler(0)
+	n := NewNetwork[Req, Resp](s, Faults{MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+	var srv Server
+	n.Listen("srv", serverHandler(&srv))
+	f1 := n.Send("client", "srv", "one")
+	f2 := WithTimeout(s, n.Send("client", "nobody", "two"), time.Second)
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f1.Result(); err != nil || v != "hello back, one (seq #1)" {
+		t.Fatalf("unexpected result: %s %v", v, err)
+	}
+	if _, err := f2.Result(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := s.Now().Sub(Epoch); d != time.Second {
+		t.Fatalf("unexpected time: %s", d)
+	}
+
+	// Messages across a partition are dropped, including those in flight.
+	f3 := WithTimeout(s, n.Send("client", "srv", "three"), time.Second)
+	n.Partition("srv", "client")
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f3.Result(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n.Heal("client", "srv")
+	f4 := n.Send("client", "srv", "four")
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f4.Result(); err != nil || v != "hello back, four (seq #2)" {
+		t.Fatalf("unexpected result: %s %v", v, err)
+	}
+	if exp, act := (NetworkStats{Sent: 6, Dropped: 1}), n.Stats(); exp != act {
+		t.Fatalf("expected %+v, got %+v", exp, act)
+	}
+}
+
+func TestNetworkFaults(t *testing.T) {
+	s := NewScheduler(0)
+	n := NewNetwork[Req, Resp](s, Faults{DuplicateRate: 1})
+	var srv Server
+	n.Listen("srv", serverHandler(&srv))
+	f := n.Send("client", "srv", "dup")
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// The request is handled twice, but only the first response is seen.
+	if v, err := f.Result(); err != nil || v != "hello back, dup (seq #1)" || srv.mu.seq != 2 {
+		t.Fatalf("unexpected result: %s %v (seq %d)", v, err, srv.mu.seq)
+	}
+
+	s = NewScheduler(0)
+	n = NewNetwork[Req, Resp](s, Faults{DropRate: 1})
+	n.Listen("srv", serverHandler(&srv))
+	f = WithTimeout(s, n.Send("client", "srv", "dropped"), time.Second)
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Result(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// counterReplica is a node of a toy replicated counter. The client sends each
+// increment to all replicas, retrying until each of them acknowledged it.
+type counterReplica struct {
+	value int
+	// dedupe makes the replica remember the increments it applied, so that
+	// retries are idempotent.
+	dedupe  bool
+	applied map[Req]bool
+}
+
+func (r *counterReplica) handle(req Req, p Promise[Resp]) []SelectCase {
+	if !r.dedupe || !r.applied[req] {
+		r.value++
+		r.applied[req] = true
+	}
+	p.Fill(Resp(strconv.Itoa(r.value)), nil)
+	return nil
+}
+
+// runCounter runs the replicated counter on an unreliable network and checks
+// that all replicas end up counting each increment once.
+func runCounter(s *Scheduler, dedupe bool) error {
+	n := NewNetwork[Req, Resp](s, Faults{
+		MinDelay:      time.Millisecond,
+		MaxDelay:      20 * time.Millisecond,
+		DropRate:      0.05,
+		DuplicateRate: 0.05,
+	})
+	addrs := []Addr{"r1", "r2", "r3"}
+	replicas := map[Addr]*counterReplica{}
+	for _, addr := range addrs {
+		r := &counterReplica{dedupe: dedupe, applied: map[Req]bool{}}
+		replicas[addr] = r
+		n.Listen(addr, r.handle)
+	}
+	s.AfterFunc(10*time.Millisecond, func() { n.Partition("client", "r3") })
+	s.AfterFunc(200*time.Millisecond, func() { n.Heal("client", "r3") })
+
+	var send func(to Addr, req Req) Future[Resp]
+	send = func(to Addr, req Req) Future[Resp] {
+		p, f := NewPromise[Resp]()
+		WithTimeout(s, n.Send("client", to, req), 50*time.Millisecond).OnDone(func(v Resp, err error) {
+			if err != nil {
+				send(to, req).OnDone(p.Fill)
+				return
+			}
+			p.Fill(v, nil)
+		})
+		return f
+	}
+	const increments = 5
+	var inc func(i int) []SelectCase
+	inc = func(i int) []SelectCase {
+		if i == increments {
+			return nil
+		}
+		var fs []Future[Resp]
+		for _, addr := range addrs {
+			fs = append(fs, send(addr, Req(fmt.Sprintf("inc%d", i))))
+		}
+		return []SelectCase{All(fs...).Case(fmt.Sprintf("acked inc%d", i), func([]Resp, error) []SelectCase {
+			return inc(i + 1)
+		})}
+	}
+	s.Spawn("client", func() []SelectCase { return inc(0) })
+	if err := s.Run(); err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if v := replicas[addr].value; v != increments {
+			return fmt.Errorf("replica %s counted %d increments, expected %d", addr, v, increments)
+		}
+	}
+	return nil
+}
+
+func TestReplicatedCounterBug(t *testing.T) {
+	var seeds []int64
+	for seed := int64(0); seed < 100; seed++ {
+		seeds = append(seeds, seed)
+	}
+	err := Explore(seeds, func(s *Scheduler) error { return runCounter(s, false /* dedupe */) })
+	var seedErr *SeedError
+	if !errors.As(err, &seedErr) {
+		t.Fatalf("expected retries to double count on some seed, got %v", err)
+	}
+	t.Log(err)
+
+	// The failure replays.
+	s := NewScheduler(seedErr.Seed)
+	if replay := runCounter(s, false /* dedupe */); replay == nil || replay.Error() != seedErr.Err.Error() {
+		t.Fatalf("replay of seed %d failed differently: %v", seedErr.Seed, replay)
+	}
+	if strings.Join(s.Trace(), "\n") != strings.Join(seedErr.Trace, "\n") {
+		t.Fatalf("replay of seed %d took different steps", seedErr.Seed)
+	}
+}
+
+func TestReplicatedCounterDedupe(t *testing.T) {
+	seeds, err := Seeds(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Explore(seeds, func(s *Scheduler) error { return runCounter(s, true /* dedupe */) }); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,388 @@
+package crdb2det
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Epoch is the initial time of the virtual clock of a Scheduler.
+var Epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// DefaultMaxSteps is the default for Scheduler.MaxSteps.
+const DefaultMaxSteps = 1 << 20
+
+type task struct {
+	name  string
+	start func() []SelectCase // until the task first runs
+	cases []SelectCase        // the select the task is blocked on
+	ready []int               // the ready cases, as determined by eligible
+}
+
+// eligible determines whether the task can run, and which of its cases are
+// ready.
+func (t *task) eligible() bool {
+	if t.start != nil {
+		return true
+	}
+	t.ready = t.ready[:0]
+	var hasDefault bool
+	for i := range t.cases {
+		c := &t.cases[i]
+		if c.isDefault() {
+			hasDefault = true
+		} else if (c.Ready == nil || c.Ready()) && (c.Lock == nil || free(c.Lock)) {
+			t.ready = append(t.ready, i)
+		}
+	}
+	return len(t.ready) > 0 || hasDefault
+}
+
+// free returns whether the mutex can be acquired.
+func free(l TryLocker) bool {
+	if !l.TryLock() {
+		return false
+	}
+	l.Unlock()
+	return true
+}
+
+// A Timer runs a function at a time of the virtual clock of a Scheduler.
+type Timer struct {
+	s     *Scheduler
+	when  time.Time
+	seq   int
+	index int // in the heap, or -1 once fired or stopped
+	fn    func()
+}
+
+// Stop prevents the timer from firing. It returns false if the timer already
+// fired or was stopped.
+func (t *Timer) Stop() bool {
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.s.timers, t.index)
+	return true
+}
+
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].when.Equal(h[j].when) {
+		return h[i].when.Before(h[j].when)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*Timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+// A Scheduler runs actors deterministically on a single goroutine. At each
+// step, it runs one of the actors that can proceed, chosen at random, along
+// with a ready case of the select the actor is blocked on, also chosen at
+// random (the default case is only chosen if no other case is ready). The
+// random choices are derived from the seed, so that a run is reproduced by
+// the same seed. The virtual clock only advances, to the next timer, when no
+// actor can proceed. Mutexes acquired through select cases are tracked, so
+// that deadlocks between actors are detected.
+type Scheduler struct {
+	// MaxSteps bounds the steps taken by Run.
+	MaxSteps int
+
+	seed   int64
+	rng    *rand.Rand
+	now    time.Time
+	tasks  []*task
+	timers timerHeap
+	seq    int // of the last timer
+	trace  []string
+	// contexts are the contexts returned by WithTimeout that may still have
+	// to be canceled by their parent.
+	contexts []*timeoutCtx
+	// holders maps the mutexes acquired through select cases to the actors
+	// that acquired them, and may be stale.
+	holders map[TryLocker]*task
+	err     error
+}
+
+// NewScheduler returns a scheduler whose choices are derived from the seed.
+func NewScheduler(seed int64) *Scheduler {
+	return &Scheduler{
+		MaxSteps: DefaultMaxSteps,
+		seed:     seed,
+		rng:      rand.New(rand.NewSource(seed)),
+		now:      Epoch,
+		holders:  map[TryLocker]*task{},
+	}
+}
+
+// Seed returns the seed of the scheduler.
+func (s *Scheduler) Seed() int64 {
+	return s.seed
+}
+
+// Now returns the time of the virtual clock.
+func (s *Scheduler) Now() time.Time {
+	return s.now
+}
+
+// Intn returns a random number in [0,n) derived from the seed, for use by
+// simulations that want their choices to be reproducible as well.
+func (s *Scheduler) Intn(n int) int {
+	return s.rng.Intn(n)
+}
+
+// Int63n is like Intn, for int64.
+func (s *Scheduler) Int63n(n int64) int64 {
+	return s.rng.Int63n(n)
+}
+
+// Float64 returns a random number in [0,1) derived from the seed.
+func (s *Scheduler) Float64() float64 {
+	return s.rng.Float64()
+}
+
+// Trace returns a description of the steps taken so far. Runs with the same
+// seed have the same trace.
+func (s *Scheduler) Trace() []string {
+	return s.trace
+}
+
+// Spawn adds an actor, which is started by calling start, for example
+//
+//	s.Spawn("server", func() []SelectCase { return a.State0(srv, ctx, req, p) })
+func (s *Scheduler) Spawn(name string, start func() []SelectCase) {
+	s.tasks = append(s.tasks, &task{name: name, start: start})
+}
+
+// AfterFunc arranges for fn to run once the virtual clock has advanced by d.
+func (s *Scheduler) AfterFunc(d time.Duration, fn func()) *Timer {
+	s.seq++
+	t := &Timer{s: s, when: s.now.Add(d), seq: s.seq, fn: fn}
+	heap.Push(&s.timers, t)
+	return t
+}
+
+func (s *Scheduler) record(format string, args ...interface{}) {
+	s.trace = append(s.trace, fmt.Sprintf("%s ", s.now.Sub(Epoch))+fmt.Sprintf(format, args...))
+}
+
+// Step takes one step, returning false if there was nothing left to do.
+func (s *Scheduler) Step() bool {
+	if s.err != nil {
+		return false
+	}
+	live := s.contexts[:0]
+	for _, c := range s.contexts {
+		if c.Err() == nil {
+			live = append(live, c)
+		}
+	}
+	s.contexts = live
+
+	var eligible []*task
+	for _, t := range s.tasks {
+		if t.eligible() {
+			eligible = append(eligible, t)
+		}
+	}
+	if len(eligible) == 0 {
+		if len(s.timers) == 0 {
+			return false
+		}
+		t := heap.Pop(&s.timers).(*Timer)
+		s.now = t.when
+		s.record("timer")
+		t.fn()
+		return true
+	}
+
+	t := eligible[s.rng.Intn(len(eligible))]
+	var run func() []SelectCase
+	if t.start != nil {
+		run, t.start = t.start, nil
+		s.record("%s: start", t.name)
+	} else {
+		c := s.choose(t)
+		run = c.Run
+		s.record("%s: %s", t.name, c.Name)
+	}
+	if t.cases = run(); t.cases == nil {
+		for i := range s.tasks {
+			if s.tasks[i] == t {
+				s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+				break
+			}
+		}
+	} else if err := s.deadlock(t); err != nil {
+		s.err = err
+		return false
+	}
+	return true
+}
+
+// choose returns the case the task proceeds with.
+func (s *Scheduler) choose(t *task) SelectCase {
+	if len(t.ready) > 0 {
+		c := t.cases[t.ready[s.rng.Intn(len(t.ready))]]
+		if c.Lock != nil {
+			if !c.Lock.TryLock() {
+				panic("free mutex could not be acquired")
+			}
+			s.holders[c.Lock] = t
+		}
+		return c
+	}
+	for _, c := range t.cases {
+		if c.isDefault() {
+			return c
+		}
+	}
+	panic("no case is ready")
+}
+
+// holder returns the actor holding the mutex, if it was acquired through a
+// select case and is still held.
+func (s *Scheduler) holder(l TryLocker) *task {
+	h := s.holders[l]
+	if h != nil && free(l) {
+		delete(s.holders, l)
+		return nil
+	}
+	return h
+}
+
+// A DeadlockError is returned by Scheduler.Run when actors wait for mutexes
+// held by each other.
+type DeadlockError struct {
+	// Cycle describes what each of the actors in the cycle waits for.
+	Cycle []string
+}
+
+func (e *DeadlockError) Error() string {
+	return "deadlock: " + strings.Join(e.Cycle, ", ")
+}
+
+// deadlock returns a *DeadlockError if the task, which just blocked, waits
+// for a mutex in a cycle of actors waiting for mutexes held by the next.
+func (s *Scheduler) deadlock(t *task) error {
+	var cycle []string
+	seen := map[*task]bool{}
+	for cur := t; !seen[cur]; {
+		seen[cur] = true
+		if len(cur.cases) != 1 || cur.cases[0].Lock == nil {
+			return nil
+		}
+		h := s.holder(cur.cases[0].Lock)
+		if h == nil {
+			return nil
+		}
+		cycle = append(cycle, fmt.Sprintf("%s waits in %s for %s", cur.name, cur.cases[0].Name, h.name))
+		if h == t {
+			return &DeadlockError{Cycle: cycle}
+		}
+		cur = h
+	}
+	// A cycle not involving the task, which was reported when it formed.
+	return nil
+}
+
+// Run takes steps until there is nothing left to do. It returns an error if
+// actors remain blocked, or if MaxSteps is exceeded. If actors deadlock on
+// mutexes, it returns a *DeadlockError right away.
+func (s *Scheduler) Run() error {
+	for i := 0; s.Step(); i++ {
+		if i >= s.MaxSteps {
+			return fmt.Errorf("exceeded %d steps", s.MaxSteps)
+		}
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.tasks) == 0 {
+		return nil
+	}
+	var blocked []string
+	for _, t := range s.tasks {
+		var names []string
+		for _, c := range t.cases {
+			name := c.Name
+			if c.Lock != nil {
+				if h := s.holder(c.Lock); h != nil {
+					name += " waiting for " + h.name
+				}
+			}
+			names = append(names, name)
+		}
+		blocked = append(blocked, fmt.Sprintf("%s (%s)", t.name, strings.Join(names, ", ")))
+	}
+	return fmt.Errorf("%d actors blocked forever: %s", len(blocked), strings.Join(blocked, ", "))
+}
+
+// SeedEnv is the environment variable which, if set, makes Seeds return only
+// the seed it holds, to replay a failure.
+const SeedEnv = "CRDB2DET_SEED"
+
+// Seeds returns n seeds, starting at a base derived from the current time,
+// unless SeedEnv is set.
+func Seeds(n int) ([]int64, error) {
+	if v := os.Getenv(SeedEnv); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", SeedEnv, err)
+		}
+		return []int64{seed}, nil
+	}
+	base := time.Now().UnixNano()
+	seeds := make([]int64, n)
+	for i := range seeds {
+		seeds[i] = base + int64(i)
+	}
+	return seeds, nil
+}
+
+// A SeedError is returned by Explore for a failed run.
+type SeedError struct {
+	Seed  int64
+	Trace []string
+	Err   error
+}
+
+func (e *SeedError) Error() string {
+	return fmt.Sprintf("seed %d: %v (replay with %s=%d)", e.Seed, e.Err, SeedEnv, e.Seed)
+}
+
+func (e *SeedError) Unwrap() error {
+	return e.Err
+}
+
+// Explore runs fn with a new Scheduler for each of the seeds, stopping at the
+// first failure, for which it returns a *SeedError.
+func Explore(seeds []int64, fn func(*Scheduler) error) error {
+	for _, seed := range seeds {
+		s := NewScheduler(seed)
+		if err := fn(s); err != nil {
+			return &SeedError{Seed: seed, Trace: s.Trace(), Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package crdb2det
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCluster sends requests to a few servers at random times, canceling some
+// of them at random times as well, and returns the responses.
+func runCluster(s *Scheduler) ([]string, error) {
+	servers := make([]Server, 3)
+	results := make([]Future[Resp], 20)
+	for i := range results {
+		i := i
+		srv := &servers[s.Intn(len(servers))]
+		ctx, cancel := context.WithCancel(context.Background())
+		var p Promise[Resp]
+		p, results[i] = NewPromise[Resp]()
+		s.AfterFunc(time.Duration(s.Intn(10))*time.Millisecond, func() {
+			var a ServerRecvActor
+			s.Spawn(fmt.Sprintf("req%d", i), func() []SelectCase {
+				return a.State0(srv, ctx, Req(fmt.Sprint(i)), p)
+			})
+		})
+		s.AfterFunc(time.Duration(s.Intn(10))*time.Millisecond, cancel)
+	}
+	if err := s.Run(); err != nil {
+		return nil, err
+	}
+	var res []string
+	for i, f := range results {
+		if !f.Done() {
+			return nil, fmt.Errorf("request %d did not complete", i)
+		}
+		v, err := f.Result()
+		res = append(res, fmt.Sprintf("%s %v", v, err))
+	}
+	return res, nil
+}
+
+func TestSchedulerDeterministic(t *testing.T) {
+	run := func(seed int64) string {
+		s := NewScheduler(seed)
+		res, err := runCluster(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(s.Trace(), "\n") + "\n" + strings.Join(res, "\n")
+	}
+	traces := map[string]bool{}
+	for seed := int64(0); seed < 10; seed++ {
+		trace := run(seed)
+		if replay := run(seed); replay != trace {
+			t.Fatalf("seed %d: replay differs:\n%s\n\nvs\n\n%s", seed, trace, replay)
+		}
+		traces[trace] = true
+	}
+	if len(traces) < 2 {
+		t.Fatal("all seeds produced the same run")
+	}
+}
+
+func TestSchedulerSelect(t *testing.T) {
+	// Both ready cases are chosen for some seeds, and the default case only
+	// when no other case is ready.
+	chosen := map[string]int{}
+	for seed := int64(0); seed < 20; seed++ {
+		s := NewScheduler(seed)
+		ch := make(chan int, 1)
+		ch <- 1
+		done := func() []SelectCase { return nil }
+		s.Spawn("a", func() []SelectCase {
+			return []SelectCase{
+				{Name: "ch", Ready: func() bool { return len(ch) > 0 }, Run: func() []SelectCase {
+					chosen["ch"]++
+					<-ch
+					return nil
+				}},
+				{Name: "always", Ready: func() bool { return true }, Run: func() []SelectCase {
+					chosen["always"]++
+					return nil
+				}},
+				{Name: "default", Run: done},
+			}
+		})
+		s.Spawn("b", func() []SelectCase {
+			return []SelectCase{
+				{Name: "never", Ready: func() bool { return false }, Run: done},
+				{Name: "default", Run: func() []SelectCase {
+					chosen["default"]++
+					return nil
+				}},
+			}
+		})
+		if err := s.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if chosen["ch"] == 0 || chosen["always"] == 0 || chosen["default"] != 20 {
+		t.Fatalf("unexpected choices: %v", chosen)
+	}
+}
+
+func TestSchedulerClock(t *testing.T) {
+	s := NewScheduler(0)
+	var fired []string
+	s.AfterFunc(2*time.Second, func() {
+		fired = append(fired, fmt.Sprintf("b at %s", s.Now().Sub(Epoch)))
+		s.AfterFunc(time.Second, func() { fired = append(fired, fmt.Sprintf("d at %s", s.Now().Sub(Epoch))) })
+	})
+	s.AfterFunc(time.Second, func() { fired = append(fired, fmt.Sprintf("a at %s", s.Now().Sub(Epoch))) })
+	stopped := s.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	s.AfterFunc(2*time.Second, func() { fired = append(fired, fmt.Sprintf("c at %s", s.Now().Sub(Epoch))) })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("unexpected result of Stop")
+	}
+	// The clock doesn't advance while actors can proceed.
+	s.Spawn("actor", func() []SelectCase {
+		fired = append(fired, fmt.Sprintf("actor at %s", s.Now().Sub(Epoch)))
+		return nil
+	})
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	exp := "actor at 0s, a at 1s, b at 2s, c at 2s, d at 3s"
+	if act := strings.Join(fired, ", "); act != exp {
+		t.Fatalf("expected %s, got %s", exp, act)
+	}
+}
+
+func TestSchedulerBlocked(t *testing.T) {
+	s := NewScheduler(0)
+	var a ServerRecvActor
+	p, _ := NewPromise[Resp]()
+	s.Spawn("server", func() []SelectCase {
+		return []SelectCase{{Name: "never", Ready: func() bool { return false }}}
+	})
+	s.Spawn("ok", func() []SelectCase { return a.State0(&Server{}, context.Background(), "x", p) })
+	err := s.Run()
+	if err == nil || err.Error() != "1 actors blocked forever: server (never)" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s = NewScheduler(0)
+	s.MaxSteps = 10
+	var spin func() []SelectCase
+	spin = func() []SelectCase { return []SelectCase{{Name: "spin", Run: spin}} }
+	s.Spawn("spin", spin)
+	if err := s.Run(); err == nil || err.Error() != "exceeded 10 steps" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestExplore(t *testing.T) {
+	t.Setenv(SeedEnv, "")
+	seeds, err := Seeds(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeds) != 5 {
+		t.Fatalf("unexpected seeds: %v", seeds)
+	}
+	errBoom := errors.New("boom")
+	err = Explore(seeds, func(s *Scheduler) error {
+		s.Spawn("a", func() []SelectCase { return nil })
+		if err := s.Run(); err != nil {
+			return err
+		}
+		if s.Seed() == seeds[2] {
+			return errBoom
+		}
+		return nil
+	})
+	var seedErr *SeedError
+	if !errors.As(err, &seedErr) || seedErr.Seed != seeds[2] || !errors.Is(err, errBoom) ||
+		len(seedErr.Trace) != 1 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exp := fmt.Sprintf("seed %d: boom (replay with %s=%d)", seeds[2], SeedEnv, seeds[2]); err.Error() != exp {
+		t.Fatalf("expected %q, got %q", exp, err)
+	}
+
+	// The seed can be set from the environment to replay a failure.
+	t.Setenv(SeedEnv, "42")
+	if seeds, err := Seeds(5); err != nil || len(seeds) != 1 || seeds[0] != 42 {
+		t.Fatalf("unexpected seeds: %v %v", seeds, err)
+	}
+}
+
+func TestMutex(t *testing.T) {
+	var mu Mutex
+	mu.Lock()
+	if mu.TryLock() {
+		t.Fatal("locked a held mutex")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != "crdb2det: Lock of a held Mutex would block the scheduler" {
+				t.Fatalf("unexpected panic: %v", r)
+			}
+		}()
+		mu.Lock()
+	}()
+	mu.Unlock()
+	if !mu.TryLock() {
+		t.Fatal("could not lock a free mutex")
+	}
+}
+
+// lockActor returns an actor that acquires the mutexes in order, and releases
+// them once it holds all of them.
+func lockActor(held *[]string, name string, mus ...*Mutex) func() []SelectCase {
+	var acquire func(i int) []SelectCase
+	acquire = func(i int) []SelectCase {
+		if i == len(mus) {
+			*held = append(*held, name)
+			for _, mu := range mus {
+				mu.Unlock()
+			}
+			return nil
+		}
+		return []SelectCase{{Name: fmt.Sprintf("Lock%d", i), Lock: mus[i], Run: func() []SelectCase {
+			return acquire(i + 1)
+		}}}
+	}
+	return func() []SelectCase { return acquire(0) }
+}
+
+func TestSchedulerLock(t *testing.T) {
+	// Actors acquiring the same mutexes in the same order take turns.
+	for seed := int64(0); seed < 20; seed++ {
+		s := NewScheduler(seed)
+		var mu1, mu2 Mutex
+		var held []string
+		for i := 0; i < 3; i++ {
+			s.Spawn(fmt.Sprint(i), lockActor(&held, fmt.Sprint(i), &mu1, &mu2))
+		}
+		if err := s.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if len(held) != 3 {
+			t.Fatalf("unexpected result: %v", held)
+		}
+	}
+
+	// Acquiring them in opposite orders deadlocks for some seeds.
+	err := Explore([]int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, func(s *Scheduler) error {
+		var mu1, mu2 Mutex
+		var held []string
+		s.Spawn("a", lockActor(&held, "a", &mu1, &mu2))
+		s.Spawn("b", lockActor(&held, "b", &mu2, &mu1))
+		return s.Run()
+	})
+	var deadlock *DeadlockError
+	if !errors.As(err, &deadlock) {
+		t.Fatalf("expected a deadlock, got %v", err)
+	}
+	if exp := []string{"a waits in Lock1 for b", "b waits in Lock1 for a"}; strings.Join(deadlock.Cycle, ", ") != strings.Join(exp, ", ") {
+		exp = []string{exp[1], exp[0]}
+		if strings.Join(deadlock.Cycle, ", ") != strings.Join(exp, ", ") {
+			t.Fatalf("unexpected cycle: %v", deadlock.Cycle)
+		}
+	}
+
+	// A mutex held by an actor that finished blocks the others forever.
+	s := NewScheduler(0)
+	var mu Mutex
+	s.Spawn("leak", func() []SelectCase {
+		return []SelectCase{{Name: "Lock", Lock: &mu, Run: func() []SelectCase { return nil }}}
+	})
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	s.Spawn("waiter", func() []SelectCase {
+		return []SelectCase{{Name: "Lock", Lock: &mu, Run: func() []SelectCase { return nil }}}
+	})
+	if err := s.Run(); err == nil || err.Error() != "1 actors blocked forever: waiter (Lock waiting for leak)" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
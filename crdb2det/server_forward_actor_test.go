@@ -0,0 +1,59 @@
+// Code generated by actorgen from main_test.go. DO NOT EDIT.
+
+package crdb2det
+
+import (
+	"context"
+	"errors"
+)
+
+// ServerForwardActor runs (*Server).Forward as a state machine.
+type ServerForwardActor struct {
+	s     *Server
+	ctx   context.Context
+	in    <-chan Req
+	recv  int
+	inVal Req
+	inOK  bool
+	p     Promise[Resp]
+}
+
+func (a *ServerForwardActor) State0(s *Server, ctx context.Context, in <-chan Req, p Promise[Resp]) []SelectCase {
+	*a = ServerForwardActor{
+		s:   s,
+		ctx: ctx,
+		in:  in,
+		p:   p,
+	}
+	return []SelectCase{
+		{Name: "State0SelectCtxDone", Ready: func() bool { return a.State0Poll(0) && a.ctx.Err() != nil }, Run: a.State0SelectCtxDone},
+		{Name: "State0SelectIn", Ready: func() bool { return a.State0Poll(2) }, Run: a.State0SelectIn},
+	}
+}
+
+func (a *ServerForwardActor) State0Poll(i int) bool {
+	if a.recv == 0 {
+		select {
+		case a.inVal, a.inOK = <-a.in:
+			a.recv = 2
+		default:
+		}
+	}
+	return a.recv == i
+}
+
+func (a *ServerForwardActor) State0SelectCtxDone() []SelectCase {
+	<-a.ctx.Done()
+	a.p.Fill("", a.ctx.Err())
+	return nil
+}
+
+func (a *ServerForwardActor) State0SelectIn() []SelectCase {
+	req, ok := a.inVal, a.inOK
+	if !ok {
+		a.p.Fill("", errors.New("closed"))
+		return nil
+	}
+	a.p.Fill(a.s.Recv(a.ctx, req))
+	return nil
+}
@@ -0,0 +1,46 @@
+// Code generated by actorgen from main_test.go. DO NOT EDIT.
+
+package crdb2det
+
+import (
+	"context"
+	"fmt"
+)
+
+// ServerRecvActor runs (*Server).Recv as a state machine.
+type ServerRecvActor struct {
+	s   *Server
+	ctx context.Context
+	req Req
+	p   Promise[Resp]
+}
+
+func (a *ServerRecvActor) State0(s *Server, ctx context.Context, req Req, p Promise[Resp]) []SelectCase {
+	*a = ServerRecvActor{
+		s:   s,
+		ctx: ctx,
+		req: req,
+		p:   p,
+	}
+	return []SelectCase{
+		{Name: "State0SelectCtxDone", Ready: func() bool { return a.ctx.Err() != nil }, Run: a.State0SelectCtxDone},
+		{Name: "State0SelectDefault", Run: a.State0SelectDefault},
+	}
+}
+
+func (a *ServerRecvActor) State0SelectCtxDone() []SelectCase {
+	<-a.ctx.Done()
+	a.p.Fill("", a.ctx.Err())
+	return nil
+}
+
+func (a *ServerRecvActor) State0SelectDefault() []SelectCase {
+	return []SelectCase{{Name: "State0SelectDefaultLockMu", Lock: &a.s.mu, Run: a.State0SelectDefaultLockMu}}
+}
+
+func (a *ServerRecvActor) State0SelectDefaultLockMu() []SelectCase {
+	a.s.mu.seq++
+	defer a.s.mu.Unlock()
+	a.p.Fill(Resp(fmt.Sprintf("hello back, %s (seq #%d)", a.req, a.s.mu.seq)), nil)
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var maxOutput = flag.Int64("max-output", 10<<20,
+	"bytes of output retained per test; beyond this, only (roughly) the first and last "+
+		"half of it are kept (0 for no limit)")
+var spillSize = flag.Int64("spill", 1<<20,
+	"bytes of output buffered in memory per test before spilling to a temporary file "+
+		"(0 to never spill)")
+
+// A spillBuffer accumulates bytes in memory until there are more than limit
+// of them, and in a temporary file from then on.
+type spillBuffer struct {
+	limit int64 // 0 for no limit
+	mem   []byte
+	f     *os.File
+	n     int64
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.f == nil && b.limit > 0 && int64(len(b.mem)+len(p)) > b.limit {
+		f, err := os.CreateTemp("", "gotestfilter-*")
+		if err != nil {
+			return 0, err
+		}
+		// The file lives on until closed, so that it can't be leaked. This
+		// fails on some platforms, in which case release removes it.
+		_ = os.Remove(f.Name())
+		if _, err := f.Write(b.mem); err != nil {
+			_ = f.Close()
+			return 0, err
+		}
+		b.f, b.mem = f, nil
+	}
+	if b.f != nil {
+		n, err := b.f.Write(p)
+		b.n += int64(n)
+		return n, err
+	}
+	b.mem = append(b.mem, p...)
+	b.n += int64(len(p))
+	return len(p), nil
+}
+
+// Len returns the number of bytes written to the buffer.
+func (b *spillBuffer) Len() int64 {
+	return b.n
+}
+
+// WriteTo implements io.WriterTo.
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.f == nil {
+		n, err := w.Write(b.mem)
+		return int64(n), err
+	}
+	return io.Copy(w, io.NewSectionReader(b.f, 0, b.n))
+}
+
+// release discards the contents of the buffer.
+func (b *spillBuffer) release() {
+	if b.f != nil {
+		_ = b.f.Close()
+		_ = os.Remove(b.f.Name())
+	}
+	*b = spillBuffer{limit: b.limit}
+}
+
+// A capBuffer holds the output of a test, as a sequence of records (chunks of
+// output or lines of test2json output) which are never split. If the output
+// exceeds maxOutput, only the records in its first half and those at its end
+// are retained, where the latter amount to between half and all of
+// maxOutput. Each part of the retained output is held in a spillBuffer, so
+// that the memory used for a test is bounded by a small multiple of
+// spillSize.
+//
+// The zero value is not usable, see newCapBuffer.
+type capBuffer struct {
+	half int64 // 0 for no limit
+	head spillBuffer
+	// Once the head is full, records are appended to cur. When cur has half
+	// of maxOutput in it, prev is discarded and replaced by cur.
+	inTail    bool
+	prev, cur spillBuffer
+	elided    int64
+}
+
+func newCapBuffer() *capBuffer {
+	b := &capBuffer{half: *maxOutput / 2}
+	b.head.limit, b.prev.limit, b.cur.limit = *spillSize, *spillSize, *spillSize
+	return b
+}
+
+// add appends a record to the buffer.
+func (b *capBuffer) add(rec string) error {
+	if !b.inTail && (b.half == 0 || b.head.Len()+int64(len(rec)) <= b.half) {
+		_, err := io.WriteString(&b.head, rec)
+		return err
+	}
+	b.inTail = true
+	if b.cur.Len() > 0 && b.cur.Len()+int64(len(rec)) > b.half {
+		b.elided += b.prev.Len()
+		b.prev.release()
+		b.prev, b.cur = b.cur, b.prev
+	}
+	_, err := io.WriteString(&b.cur, rec)
+	return err
+}
+
+// writeTo writes the retained records to w. If some were elided, note is
+// called with the number of elided bytes, and its result is written in their
+// place.
+func (b *capBuffer) writeTo(w io.Writer, note func(elided int64) string) error {
+	if _, err := b.head.WriteTo(w); err != nil {
+		return err
+	}
+	if b.elided > 0 {
+		if _, err := io.WriteString(w, note(b.elided)); err != nil {
+			return err
+		}
+	}
+	if _, err := b.prev.WriteTo(w); err != nil {
+		return err
+	}
+	_, err := b.cur.WriteTo(w)
+	return err
+}
+
+// elisionNote is the note for elided test output in text form.
+func elisionNote(elided int64) string {
+	return fmt.Sprintf("\n... [%d bytes of output elided] ...\n", elided)
+}
+
+// String returns the retained output, with elisionNote marking elided
+// output. Reading it from spilled files, it returns any error encountered in
+// its place.
+func (b *capBuffer) String() string {
+	var sb strings.Builder
+	if err := b.writeTo(&sb, elisionNote); err != nil {
+		return fmt.Sprintf("unable to read output: %s", err)
+	}
+	return sb.String()
+}
+
+// release discards the contents of the buffer.
+func (b *capBuffer) release() {
+	b.head.release()
+	b.prev.release()
+	b.cur.release()
+	b.inTail, b.elided = false, 0
+}
+
+// readLine returns the next line read from r, without the EOL marker. Lines
+// may be arbitrarily long, but those that can't be test2json output (which
+// is a JSON object on each line) are skipped without buffering them.
+func readLine(r *bufio.Reader) (string, error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(chunk) == 0 || chunk[0] != '{' {
+			// Not test2json output.
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		line := append([]byte(nil), chunk...)
+		for err == bufio.ErrBufferFull {
+			chunk, err = r.ReadSlice('\n')
+			line = append(line, chunk...)
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		// Any error is io.EOF, which is returned by the next call.
+		s := strings.TrimSuffix(string(line), "\n")
+		return strings.TrimSuffix(s, "\r"), nil
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// withLimits sets maxOutput and spillSize for the duration of the test.
+func withLimits(t *testing.T, max, spill int64) {
+	prevMax, prevSpill := *maxOutput, *spillSize
+	*maxOutput, *spillSize = max, spill
+	t.Cleanup(func() { *maxOutput, *spillSize = prevMax, prevSpill })
+}
+
+func TestCapBuffer(t *testing.T) {
+	for _, spill := range []int64{0, 7} {
+		t.Run(fmt.Sprintf("spill=%d", spill), func(t *testing.T) {
+			withLimits(t, 20, spill)
+			b := newCapBuffer()
+			defer b.release()
+			for i := 0; i < 100; i++ {
+				if err := b.add(fmt.Sprintf("%02d\n", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if spill > 0 && (b.head.f == nil || b.prev.f == nil) {
+				t.Fatal("expected buffers to spill")
+			}
+			// Up to the first 10 bytes are retained, and 10 to 20 bytes at
+			// the end.
+			const exp = "00\n01\n02\n\n... [279 bytes of output elided] ...\n" +
+				"96\n97\n98\n99\n"
+			if s := b.String(); s != exp {
+				t.Fatalf("expected:\n%q\ngot:\n%q", exp, s)
+			}
+
+			// A released buffer can be reused.
+			b.release()
+			if err := b.add("x\n"); err != nil {
+				t.Fatal(err)
+			}
+			if s := b.String(); s != "x\n" {
+				t.Fatalf("unexpected contents: %q", s)
+			}
+		})
+	}
+}
+
+func TestCapBufferUnlimited(t *testing.T) {
+	withLimits(t, 0, 10)
+	b := newCapBuffer()
+	defer b.release()
+	var exp strings.Builder
+	for i := 0; i < 100; i++ {
+		rec := fmt.Sprintf("%d\n", i)
+		exp.WriteString(rec)
+		if err := b.add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := b.String(); s != exp.String() {
+		t.Fatalf("expected:\n%q\ngot:\n%q", exp.String(), s)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := `{"Output":"` + strings.Repeat("x", 100<<10) + `"}`
+	in := strings.Join([]string{
+		"not json " + strings.Repeat("y", 100<<10),
+		long,
+		`{"a":1}` + "\r",
+		"",
+		`{"b":2}`,
+	}, "\n")
+	r := bufio.NewReaderSize(strings.NewReader(in), 16)
+	for _, exp := range []string{long, `{"a":1}`, `{"b":2}`} {
+		line, err := readLine(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != exp {
+			t.Fatalf("expected %.20q, got %.20q", exp, line)
+		}
+	}
+	if _, err := readLine(r); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestFilterMaxOutput(t *testing.T) {
+	withLimits(t, 1000, 50)
+	evs := []string{"run TestA", "run TestA/sub"}
+	for i := 0; i < 100; i++ {
+		evs = append(evs, fmt.Sprintf("output TestA/sub line %d", i))
+	}
+	evs = append(evs, "fail TestA/sub", "fail TestA")
+	out, err := runFilter(t, "omit", events(t, evs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireEqual(t, []string{
+		"run TestA",
+		"run TestA/sub",
+		"output TestA/sub line 0",
+		"output TestA/sub line 1",
+		"output TestA/sub line 2",
+		"output TestA \n... [9837 bytes of output elided] ...",
+		"output TestA/sub line 95",
+		"output TestA/sub line 96",
+		"output TestA/sub line 97",
+		"output TestA/sub line 98",
+		"output TestA/sub line 99",
+		"fail TestA/sub",
+		"fail TestA",
+	}, out)
+}
@@ -0,0 +1,372 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var modulePath = flag.String("module", "",
+	"in github mode, the module path of the repository root, used to locate the files of "+
+		"packages (defaults to the module declared in ./go.mod)")
+
+// A location is a position in a test file, as printed by t.Error and friends.
+type location struct {
+	file string // base name
+	line int
+	msg  string
+}
+
+var locationRE = regexp.MustCompile(`^\s+([^\s:]+\.go):(\d+): (.*)$`)
+
+// locations returns the locations printed in the output of a test.
+func locations(output string) []location {
+	var res []location
+	for _, l := range strings.Split(output, "\n") {
+		m := locationRE.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		line, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		res = append(res, location{file: m[1], line: line, msg: m[3]})
+	}
+	return res
+}
+
+// goModModule returns the module declared in ./go.mod, if any.
+func goModModule() string {
+	f, err := os.Open("go.mod")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if f := strings.Fields(s.Text()); len(f) == 2 && f[0] == "module" {
+			return strings.Trim(f[1], `"`)
+		}
+	}
+	return ""
+}
+
+// ciOutputs buffers the output of running tests for the CI modes.
+type ciOutputs map[tup]*capBuffer
+
+func (o ciOutputs) add(ev *testEvent) error {
+	key := tup{ev.Package, ev.Test}
+	b := o[key]
+	if b == nil {
+		b = newCapBuffer()
+		o[key] = b
+	}
+	if ev.Action == "output" {
+		return b.add(ev.Output)
+	}
+	return nil
+}
+
+// take returns the output of the test and forgets about it.
+func (o ciOutputs) take(key tup) string {
+	b := o[key]
+	if b == nil {
+		return ""
+	}
+	delete(o, key)
+	defer b.release()
+	return b.String()
+}
+
+// packages returns the packages with tests that are still running, sorted.
+func (o ciOutputs) packages() []string {
+	seen := map[string]bool{}
+	var pkgs []string
+	for key := range o {
+		if !seen[key.pkg] {
+			seen[key.pkg] = true
+			pkgs = append(pkgs, key.pkg)
+		}
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// running returns the tests of the package that are still running, innermost
+// first, so that subtests are reported before their parents.
+func (o ciOutputs) running(pkg string) []string {
+	var tests []string
+	for key := range o {
+		if key.pkg == pkg {
+			tests = append(tests, key.test)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(tests)))
+	return tests
+}
+
+// ciPackages tracks the package-level events for the CI modes.
+type ciPackages map[string]*pkg
+
+func (ps ciPackages) get(name string) *pkg {
+	p := ps[name]
+	if p == nil {
+		p = &pkg{name: name}
+		ps[name] = p
+	}
+	return p
+}
+
+// githubFile returns the path of a file of the package relative to the root
+// of the given module, or the file itself if the package is not part of it.
+func githubFile(module, pkg, file string) string {
+	if module == "" || (pkg != module && !strings.HasPrefix(pkg, module+"/")) {
+		return file
+	}
+	return strings.TrimPrefix(path.Join(strings.TrimPrefix(pkg, module), file), "/")
+}
+
+// githubEscapeData and githubEscapeProperty escape the message and the
+// properties of a GitHub Actions workflow command, respectively.
+var githubEscapeData = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+var githubEscapeProperty = strings.NewReplacer(
+	"%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+
+// github prints the output of failed tests in collapsible groups, each
+// followed by an error annotation for each location in a test file found in
+// it (or a single one without a location, if there is none and no subtest
+// failed), as understood by GitHub Actions. Files are located relative to
+// the repository root using the -module flag. Tests that did not terminate
+// are reported as failed along with the package output, which explains why
+// (a panic or a timeout, for example), once their package fails or at the
+// end, unless the failure is explained by a failing test instead (see
+// pkg.attribute). So is a package that failed without a failing test (a
+// build failure, for example). In both cases, an error is returned.
+func github(in io.Reader, out io.Writer, sum *summary) error {
+	module := *modulePath
+	if module == "" {
+		module = goModModule()
+	}
+	outputs := ciOutputs{}
+	pkgs := ciPackages{}
+	failedSubtests := map[tup]bool{}
+	var unterminated, failedPkgs int
+	ew := &errWriter{w: out}
+	// annotate reports a failed test. The annotation without a location, if
+	// any, holds msg, or the output if msg is empty.
+	annotate := func(pkg, test, note, output, msg string) {
+		if i := strings.LastIndexByte(test, '/'); i >= 0 {
+			failedSubtests[tup{pkg, test[:i]}] = true
+		}
+		title := githubEscapeProperty.Replace(pkg + " " + test)
+		fmt.Fprintf(ew, "::group::--- FAIL: %s %s %s\n", pkg, test, note)
+		fmt.Fprint(ew, output)
+		fmt.Fprintln(ew, "::endgroup::")
+		locs := locations(output)
+		for _, loc := range locs {
+			fmt.Fprintf(ew, "::error file=%s,line=%d,title=%s::%s\n",
+				githubEscapeProperty.Replace(githubFile(module, pkg, loc.file)), loc.line, title,
+				githubEscapeData.Replace(loc.msg))
+		}
+		if len(locs) == 0 && !failedSubtests[tup{pkg, test}] {
+			if msg == "" {
+				msg = strings.TrimSpace(output)
+			}
+			fmt.Fprintf(ew, "::error title=%s::%s\n", title, githubEscapeData.Replace(msg))
+		}
+		delete(failedSubtests, tup{pkg, test})
+	}
+	// failPackage reports the failure of the package, which may have cut the
+	// running tests short.
+	failPackage := func(p *pkg) {
+		running := outputs.running(p.name)
+		attributed := p.attributeTests(running)
+		for _, test := range attributed {
+			annotate(p.name, test, "(did not terminate)",
+				outputs.take(tup{p.name, test})+p.output(), p.reason())
+			p.failedTest = true
+		}
+		// The other running tests weren't to blame (they may have been
+		// paused parallel tests, for example), but didn't terminate either.
+		unterminated += len(running)
+		for _, test := range running {
+			outputs.take(tup{p.name, test})
+		}
+		if p.failed && !p.failedTest {
+			annotate(p.name, packageTestName, "(package failed)", p.output(), p.failureMessage())
+			failedPkgs++
+		}
+	}
+	if err := scanEvents(in, func(line string, ev *testEvent) error {
+		sum.observe(ev)
+		p := pkgs.get(ev.Package)
+		if ev.Test == "" {
+			p.add(line, ev)
+			if ev.Action == "fail" {
+				failPackage(p)
+			}
+			return ew.err
+		}
+		if err := outputs.add(ev); err != nil {
+			return err
+		}
+		switch ev.Action {
+		case "pass", "skip":
+			outputs.take(tup{ev.Package, ev.Test})
+		case "fail":
+			p.failedTest = true
+			annotate(ev.Package, ev.Test, fmt.Sprintf("(%.2fs)", ev.Elapsed),
+				outputs.take(tup{ev.Package, ev.Test}), "")
+		}
+		return ew.err
+	}); err != nil {
+		return err
+	}
+	for _, name := range outputs.packages() {
+		failPackage(pkgs.get(name))
+	}
+	if ew.err != nil {
+		return ew.err
+	}
+	return packageErr(unterminated, failedPkgs)
+}
+
+// teamcityEscape escapes values in TeamCity service messages.
+var teamcityEscape = strings.NewReplacer(
+	"|", "||", "'", "|'", "\n", "|n", "\r", "|r", "[", "|[", "]", "|]",
+	"\u0085", "|x", "\u2028", "|l", "\u2029", "|p")
+
+// teamcity prints TeamCity service messages for the tests. Packages are
+// reported as suites. The messages for a test are all printed when it
+// terminates, so that the interleaving of parallel tests doesn't confuse
+// TeamCity. Tests that did not terminate are reported as failed along with
+// the package output once their package fails or at the end, unless the
+// failure is explained by a failing test instead (see pkg.attribute), and so
+// is a package that failed without a failing test. In both cases, an error
+// is returned.
+func teamcity(in io.Reader, out io.Writer, sum *summary) error {
+	outputs := ciOutputs{}
+	pkgs := ciPackages{}
+	suites := map[string]bool{} // started and unfinished
+	var unterminated, failedPkgs int
+	ew := &errWriter{w: out}
+	msg := func(name string, attrs ...string) {
+		fmt.Fprintf(ew, "##teamcity[%s", name)
+		for i := 0; i+1 < len(attrs); i += 2 {
+			fmt.Fprintf(ew, " %s='%s'", attrs[i], teamcityEscape.Replace(attrs[i+1]))
+		}
+		fmt.Fprintln(ew, "]")
+	}
+	// fail reports a test that failed without terminating regularly.
+	fail := func(test, message, details string) {
+		msg("testStarted", "name", test, "captureStandardOutput", "false")
+		msg("testFailed", "name", test, "message", message, "details", details)
+		msg("testFinished", "name", test)
+	}
+	// failPackage reports the failure of the package, which may have cut the
+	// running tests short.
+	failPackage := func(p *pkg) {
+		running := outputs.running(p.name)
+		attributed := p.attributeTests(running)
+		for _, test := range attributed {
+			fail(test, "test did not terminate: "+p.reason(), outputs.take(tup{p.name, test})+p.output())
+			p.failedTest = true
+		}
+		// The other running tests weren't to blame (they may have been
+		// paused parallel tests, for example), but didn't terminate either.
+		unterminated += len(running)
+		for _, test := range running {
+			outputs.take(tup{p.name, test})
+		}
+		if p.failed && !p.failedTest {
+			fail(packageTestName, p.failureMessage(), p.output())
+			failedPkgs++
+		}
+	}
+	finishSuite := func(name string) {
+		if suites[name] {
+			delete(suites, name)
+			msg("testSuiteFinished", "name", name)
+		}
+	}
+	if err := scanEvents(in, func(line string, ev *testEvent) error {
+		sum.observe(ev)
+		if !suites[ev.Package] && ev.Action != "pass" && ev.Action != "fail" && ev.Action != "skip" {
+			suites[ev.Package] = true
+			msg("testSuiteStarted", "name", ev.Package)
+		}
+		p := pkgs.get(ev.Package)
+		if ev.Test == "" {
+			p.add(line, ev)
+			switch ev.Action {
+			case "pass", "fail", "skip":
+				if ev.Action == "fail" {
+					failPackage(p)
+				}
+				finishSuite(ev.Package)
+			}
+			return ew.err
+		}
+		if err := outputs.add(ev); err != nil {
+			return err
+		}
+		switch ev.Action {
+		case "pass", "skip", "fail":
+			output := outputs.take(tup{ev.Package, ev.Test})
+			msg("testStarted", "name", ev.Test, "captureStandardOutput", "false")
+			if output != "" {
+				msg("testStdOut", "name", ev.Test, "out", output)
+			}
+			switch ev.Action {
+			case "skip":
+				msg("testIgnored", "name", ev.Test, "message", "skipped")
+			case "fail":
+				p.failedTest = true
+				message := "Failed"
+				if locs := locations(output); len(locs) > 0 {
+					message = fmt.Sprintf("%s:%d: %s", locs[0].file, locs[0].line, locs[0].msg)
+				}
+				msg("testFailed", "name", ev.Test, "message", message, "details", output)
+			}
+			msg("testFinished", "name", ev.Test, "duration", strconv.Itoa(int(ev.Elapsed*1000)))
+		}
+		return ew.err
+	}); err != nil {
+		return err
+	}
+	// Tests that didn't terminate are reported as failed, and unfinished
+	// suites are finished.
+	for _, name := range outputs.packages() {
+		failPackage(pkgs.get(name))
+	}
+	var names []string
+	for name := range suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		finishSuite(name)
+	}
+	if ew.err != nil {
+		return ew.err
+	}
+	return packageErr(unterminated, failedPkgs)
+}
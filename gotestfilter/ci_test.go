@@ -0,0 +1,228 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+var ciEvents = []string{
+	"run TestA",
+	"run TestA/sub",
+	"output TestA/sub === RUN   TestA/sub",
+	"output TestA/sub     a_test.go:12: got 1, 100% [wrong]",
+	"output TestA/sub --- FAIL: TestA/sub (0.00s)",
+	"fail TestA/sub",
+	"output TestA --- FAIL: TestA (0.00s)",
+	"fail TestA",
+	"run TestB",
+	"pass TestB",
+	"run TestC",
+	"output TestC panic: boom",
+	"fail TestC",
+	"run TestD",
+	"skip TestD",
+	"run TestE",
+	"output TestE stuck",
+}
+
+func TestLocations(t *testing.T) {
+	locs := locations("=== RUN   TestA\n    a_test.go:12: msg: x\n        sub/b_test.go:3: y\nc.go:1: no indent\n")
+	if len(locs) != 2 {
+		t.Fatalf("unexpected locations: %+v", locs)
+	}
+	if exp := (location{file: "a_test.go", line: 12, msg: "msg: x"}); locs[0] != exp {
+		t.Fatalf("expected %+v, got %+v", exp, locs[0])
+	}
+	if exp := (location{file: "sub/b_test.go", line: 3, msg: "y"}); locs[1] != exp {
+		t.Fatalf("expected %+v, got %+v", exp, locs[1])
+	}
+}
+
+func TestGithubFile(t *testing.T) {
+	for _, tc := range []struct{ module, pkg, exp string }{
+		{"", "example.com/m/p", "a_test.go"},
+		{"example.com/m", "example.com/m", "a_test.go"},
+		{"example.com/m", "example.com/m/p/q", "p/q/a_test.go"},
+		{"example.com/m", "example.com/mm/p", "a_test.go"},
+	} {
+		if act := githubFile(tc.module, tc.pkg, "a_test.go"); act != tc.exp {
+			t.Errorf("%s %s: expected %s, got %s", tc.module, tc.pkg, tc.exp, act)
+		}
+	}
+}
+
+func TestGithub(t *testing.T) {
+	defer func(prev string) { *modulePath = prev }(*modulePath)
+	*modulePath = "p"
+	var buf strings.Builder
+	err := github(strings.NewReader(events(t, ciEvents...)), &buf, nil)
+	if err == nil || !strings.Contains(err.Error(), "1 tests did not terminate") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	requireEqual(t, []string{
+		"::group::--- FAIL: p TestA/sub (0.00s)",
+		"=== RUN   TestA/sub",
+		"    a_test.go:12: got 1, 100% [wrong]",
+		"--- FAIL: TestA/sub (0.00s)",
+		"::endgroup::",
+		"::error file=a_test.go,line=12,title=p TestA/sub::got 1, 100%25 [wrong]",
+		// The failure of TestA is explained by that of its subtest.
+		"::group::--- FAIL: p TestA (0.00s)",
+		"--- FAIL: TestA (0.00s)",
+		"::endgroup::",
+		"::group::--- FAIL: p TestC (0.00s)",
+		"panic: boom",
+		"::endgroup::",
+		"::error title=p TestC::panic: boom",
+		// TestE didn't terminate, but isn't blamed, since the failure of
+		// TestC explains that of the package.
+		"",
+	}, strings.Split(buf.String(), "\n"))
+}
+
+func TestTeamcity(t *testing.T) {
+	var buf strings.Builder
+	in := `{"Action":"start","Package":"p"}` + "\n" + events(t, ciEvents...)
+	err := teamcity(strings.NewReader(in), &buf, nil)
+	if err == nil || !strings.Contains(err.Error(), "1 tests did not terminate") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	subOut := "=== RUN   TestA/sub|n    a_test.go:12: got 1, 100% |[wrong|]|n--- FAIL: TestA/sub (0.00s)|n"
+	requireEqual(t, []string{
+		"##teamcity[testSuiteStarted name='p']",
+		"##teamcity[testStarted name='TestA/sub' captureStandardOutput='false']",
+		"##teamcity[testStdOut name='TestA/sub' out='" + subOut + "']",
+		"##teamcity[testFailed name='TestA/sub' message='a_test.go:12: got 1, 100% |[wrong|]' details='" + subOut + "']",
+		"##teamcity[testFinished name='TestA/sub' duration='0']",
+		"##teamcity[testStarted name='TestA' captureStandardOutput='false']",
+		"##teamcity[testStdOut name='TestA' out='--- FAIL: TestA (0.00s)|n']",
+		"##teamcity[testFailed name='TestA' message='Failed' details='--- FAIL: TestA (0.00s)|n']",
+		"##teamcity[testFinished name='TestA' duration='0']",
+		"##teamcity[testStarted name='TestB' captureStandardOutput='false']",
+		"##teamcity[testFinished name='TestB' duration='0']",
+		"##teamcity[testStarted name='TestC' captureStandardOutput='false']",
+		"##teamcity[testStdOut name='TestC' out='panic: boom|n']",
+		"##teamcity[testFailed name='TestC' message='Failed' details='panic: boom|n']",
+		"##teamcity[testFinished name='TestC' duration='0']",
+		"##teamcity[testStarted name='TestD' captureStandardOutput='false']",
+		"##teamcity[testIgnored name='TestD' message='skipped']",
+		"##teamcity[testFinished name='TestD' duration='0']",
+		"##teamcity[testSuiteFinished name='p']",
+		"",
+	}, strings.Split(buf.String(), "\n"))
+}
+
+// ciPackageEvents has a package that times out while running a test, and one
+// that fails to build.
+var ciPackageEvents = []string{
+	"run TestA",
+	"pass TestA",
+	"run TestSlow",
+	"output TestSlow waiting",
+	"output  panic: test timed out after 1m0s",
+	"output  running tests:",
+	"output  \tTestSlow (1m0s)",
+	"fail ",
+}
+
+func TestGithubPackageFailure(t *testing.T) {
+	defer func(prev string) { *modulePath = prev }(*modulePath)
+	*modulePath = "p"
+	var buf strings.Builder
+	in := events(t, ciPackageEvents...) +
+		`{"Action":"output","Package":"q","Output":"q/a_test.go:3:2: undefined: x\n"}` + "\n" +
+		`{"Action":"fail","Package":"q"}` + "\n"
+	err := github(strings.NewReader(in), &buf, nil)
+	if err == nil || !strings.Contains(err.Error(), "1 tests did not terminate") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	requireEqual(t, []string{
+		"::group::--- FAIL: p TestSlow (did not terminate)",
+		"waiting",
+		"panic: test timed out after 1m0s",
+		"running tests:",
+		"\tTestSlow (1m0s)",
+		"::endgroup::",
+		"::error title=p TestSlow::panic: test timed out after 1m0s",
+		"::group::--- FAIL: q TestMain (package failed)",
+		"q/a_test.go:3:2: undefined: x",
+		"::endgroup::",
+		"::error title=q TestMain::package failed",
+		"",
+	}, strings.Split(buf.String(), "\n"))
+
+	buf.Reset()
+	err = github(strings.NewReader(in[strings.Index(in, `{"Action":"output","Package":"q"`):]), &buf, nil)
+	if err == nil || !strings.Contains(err.Error(), "1 packages failed without a failing test") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTeamcityPackageFailure(t *testing.T) {
+	var buf strings.Builder
+	in := events(t, ciPackageEvents...) + `{"Action":"fail","Package":"q"}` + "\n"
+	err := teamcity(strings.NewReader(in), &buf, nil)
+	if err == nil || !strings.Contains(err.Error(), "1 tests did not terminate") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	requireEqual(t, []string{
+		"##teamcity[testSuiteStarted name='p']",
+		"##teamcity[testStarted name='TestA' captureStandardOutput='false']",
+		"##teamcity[testFinished name='TestA' duration='0']",
+		"##teamcity[testStarted name='TestSlow' captureStandardOutput='false']",
+		"##teamcity[testFailed name='TestSlow' message='test did not terminate: panic: test timed out after 1m0s' " +
+			"details='waiting|npanic: test timed out after 1m0s|nrunning tests:|n\tTestSlow (1m0s)|n']",
+		"##teamcity[testFinished name='TestSlow']",
+		"##teamcity[testSuiteFinished name='p']",
+		"##teamcity[testStarted name='TestMain' captureStandardOutput='false']",
+		"##teamcity[testFailed name='TestMain' message='package failed' details='']",
+		"##teamcity[testFinished name='TestMain']",
+		"",
+	}, strings.Split(buf.String(), "\n"))
+}
+
+func TestCIPausedParallel(t *testing.T) {
+	// A parallel test is paused when another test panics. The panic is
+	// explained by the failing test, so the paused test isn't reported, but
+	// it didn't terminate either.
+	in := events(t,
+		"run TestPar",
+		"output TestPar === RUN   TestPar",
+		"output TestPar === PAUSE TestPar",
+		"pause TestPar",
+		"run TestPanic",
+		"output TestPanic panic: boom [recovered]",
+		"fail TestPanic",
+		"output  FAIL\tp\t0.005s",
+		"fail ",
+	)
+	for name, run := range map[string]func(io.Reader, io.Writer, *summary) error{
+		"github":   github,
+		"teamcity": teamcity,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf strings.Builder
+			err := run(strings.NewReader(in), &buf, nil)
+			if err == nil || !strings.Contains(err.Error(), "1 tests did not terminate") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Contains(buf.String(), "TestPar") {
+				t.Fatalf("paused test was reported:\n%s", buf.String())
+			}
+			if !strings.Contains(buf.String(), "TestPanic") {
+				t.Fatalf("failing test wasn't reported:\n%s", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const diffUsage = `usage: %s diff [options] old.json new.json
+
+Compares two go test -json streams and reports newly failing, newly passing,
+disappeared and slower tests, as well as packages that newly fail (to build,
+for example). Exits nonzero if there are newly failing tests or packages.
+
+`
+
+// diffOptions configure diff.
+type diffOptions struct {
+	// Slowdown is the factor by which the elapsed time of a test must grow
+	// to be reported as a regression.
+	Slowdown float64
+	// MinDelta is the minimum growth of the elapsed time of a test to be
+	// reported as a regression, which filters out noise in fast tests.
+	MinDelta time.Duration
+	// FailDisappeared makes disappeared tests an error, like newly failing
+	// ones.
+	FailDisappeared bool
+}
+
+// outcome is the aggregated result of a test in a run, or of a package, for
+// which the key has an empty test name.
+type outcome struct {
+	result  string  // "pass", "fail" or "skip"
+	elapsed float64 // seconds
+	running bool
+}
+
+// runDiff runs the diff subcommand with the given arguments.
+func runDiff(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), diffUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	var opts diffOptions
+	fs.Float64Var(&opts.Slowdown, "slowdown", 1.5,
+		"factor by which a test must slow down to be reported")
+	fs.DurationVar(&opts.MinDelta, "min-delta", time.Second,
+		"minimum slowdown of a test to be reported")
+	fs.BoolVar(&opts.FailDisappeared, "fail-disappeared", false,
+		"exit nonzero if tests disappeared, as they do when a package fails to build")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected two files, got %d", fs.NArg())
+	}
+	var runs [2]io.Reader
+	for i, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		runs[i] = f
+	}
+	return diff(runs[0], runs[1], out, opts)
+}
+
+// outcomes reads a go test -json stream and returns the outcome of each test
+// and package in it. A test that ran multiple times failed if any iteration
+// failed, and its elapsed time is the maximum of all iterations. The same
+// goes for packages. Tests that didn't terminate failed.
+func outcomes(in io.Reader) (map[tup]outcome, error) {
+	res := map[tup]outcome{}
+	if err := scanEvents(in, func(_ string, ev *testEvent) error {
+		key := tup{ev.Package, ev.Test}
+		o := res[key]
+		switch ev.Action {
+		case "run":
+			o.running = true
+		case "pass", "skip", "fail":
+			o.running = false
+			// A failure sticks, and a pass beats a skip.
+			if o.result == "" || ev.Action == "fail" || (ev.Action == "pass" && o.result == "skip") {
+				o.result = ev.Action
+			}
+			if ev.Elapsed > o.elapsed {
+				o.elapsed = ev.Elapsed
+			}
+		default:
+			return nil
+		}
+		res[key] = o
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for key, o := range res {
+		if o.running {
+			o.result = "fail"
+			res[key] = o
+		}
+	}
+	return res, nil
+}
+
+// diff compares the old and new go test -json streams and reports newly
+// failing tests (including new tests that fail), newly passing tests,
+// disappeared tests and passing tests that got slower, as well as newly
+// failing and newly passing packages. It returns an error if there are newly
+// failing tests or packages, or disappeared tests if opts.FailDisappeared is
+// set.
+func diff(oldIn, newIn io.Reader, out io.Writer, opts diffOptions) error {
+	oldRes, err := outcomes(oldIn)
+	if err != nil {
+		return err
+	}
+	newRes, err := outcomes(newIn)
+	if err != nil {
+		return err
+	}
+
+	var failing, passing, disappeared, slower []tup
+	var failingPkgs, passingPkgs []tup
+	for key, n := range newRes {
+		o, ok := oldRes[key]
+		if key.test == "" {
+			switch {
+			case n.result == "fail" && (!ok || o.result != "fail"):
+				failingPkgs = append(failingPkgs, key)
+			case n.result == "pass" && ok && o.result == "fail":
+				passingPkgs = append(passingPkgs, key)
+			}
+			continue
+		}
+		switch {
+		case n.result == "fail" && (!ok || o.result != "fail"):
+			failing = append(failing, key)
+		case n.result == "pass" && ok && o.result == "fail":
+			passing = append(passing, key)
+		case n.result == "pass" && ok && o.result == "pass":
+			delta := time.Duration((n.elapsed - o.elapsed) * float64(time.Second))
+			if n.elapsed > o.elapsed*opts.Slowdown && delta >= opts.MinDelta {
+				slower = append(slower, key)
+			}
+		}
+	}
+	for key := range oldRes {
+		if _, ok := newRes[key]; !ok && key.test != "" {
+			disappeared = append(disappeared, key)
+		}
+	}
+
+	ew := &errWriter{w: out}
+	section := func(title string, keys []tup, detail func(tup) string) {
+		if len(keys) == 0 {
+			return
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].pkg != keys[j].pkg {
+				return keys[i].pkg < keys[j].pkg
+			}
+			return keys[i].test < keys[j].test
+		})
+		fmt.Fprintf(ew, "%s:\n", title)
+		for _, key := range keys {
+			if key.test == "" {
+				fmt.Fprintf(ew, "  %s%s\n", key.pkg, detail(key))
+			} else {
+				fmt.Fprintf(ew, "  %s %s%s\n", key.pkg, key.test, detail(key))
+			}
+		}
+	}
+	none := func(tup) string { return "" }
+	section("Newly failing packages", failingPkgs, func(key tup) string {
+		if _, ok := oldRes[key]; !ok {
+			return " (new package)"
+		}
+		return ""
+	})
+	section("Newly passing packages", passingPkgs, none)
+	section("Newly failing tests", failing, func(key tup) string {
+		if _, ok := oldRes[key]; !ok {
+			return " (new test)"
+		}
+		return ""
+	})
+	section("Newly passing tests", passing, none)
+	section("Disappeared tests", disappeared, none)
+	section("Slower tests", slower, func(key tup) string {
+		return fmt.Sprintf(": %.2fs -> %.2fs", oldRes[key].elapsed, newRes[key].elapsed)
+	})
+	if ew.err != nil {
+		return ew.err
+	}
+	var problems []string
+	if len(failing) != 0 {
+		problems = append(problems, fmt.Sprintf("%d newly failing tests", len(failing)))
+	}
+	if len(failingPkgs) != 0 {
+		problems = append(problems, fmt.Sprintf("%d newly failing packages", len(failingPkgs)))
+	}
+	if opts.FailDisappeared && len(disappeared) != 0 {
+		problems = append(problems, fmt.Sprintf("%d disappeared tests", len(disappeared)))
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	// withElapsed sets the elapsed time of the terminating events of the
+	// given test.
+	withElapsed := func(s, test, elapsed string) string {
+		return strings.Replace(s, `"Test":"`+test+`"}`, `"Test":"`+test+`","Elapsed":`+elapsed+`}`, -1)
+	}
+	oldRun := events(t,
+		"run TestStable",
+		"pass TestStable",
+		"run TestFixed",
+		"fail TestFixed",
+		"run TestBroken",
+		"pass TestBroken",
+		"run TestGone",
+		"pass TestGone",
+		"run TestSlow",
+		"pass TestSlow",
+		"run TestNoisy",
+		"pass TestNoisy",
+	)
+	oldRun = withElapsed(oldRun, "TestSlow", "2")
+	oldRun = withElapsed(oldRun, "TestNoisy", "0.1")
+	newRun := events(t,
+		"run TestStable",
+		"pass TestStable",
+		"run TestFixed",
+		"pass TestFixed",
+		"run TestBroken",
+		"pass TestBroken",
+		"run TestBroken",
+		"fail TestBroken",
+		"run TestSlow",
+		"pass TestSlow",
+		"run TestNoisy",
+		"pass TestNoisy",
+		"run TestNew",
+		"output TestNew hanging",
+	)
+	newRun = withElapsed(newRun, "TestSlow", "5")
+	newRun = withElapsed(newRun, "TestNoisy", "0.5")
+
+	opts := diffOptions{Slowdown: 1.5, MinDelta: time.Second}
+	var buf strings.Builder
+	err := diff(strings.NewReader(oldRun), strings.NewReader(newRun), &buf, opts)
+	if err == nil || err.Error() != "2 newly failing tests" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const exp = `Newly failing tests:
+  p TestBroken
+  p TestNew (new test)
+Newly passing tests:
+  p TestFixed
+Disappeared tests:
+  p TestGone
+Slower tests:
+  p TestSlow: 2.00s -> 5.00s
+`
+	if s := buf.String(); s != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, s)
+	}
+
+	// No news is good news.
+	buf.Reset()
+	if err := diff(strings.NewReader(oldRun), strings.NewReader(oldRun), &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestDiffPackages(t *testing.T) {
+	oldRun := events(t,
+		"run TestA",
+		"pass TestA",
+		"pass ",
+	)
+	newRun := events(t,
+		"output  p/a_test.go:3:2: undefined: x",
+		"fail ",
+	)
+	var buf strings.Builder
+	err := diff(strings.NewReader(oldRun), strings.NewReader(newRun), &buf, diffOptions{})
+	if err == nil || err.Error() != "1 newly failing packages" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const exp = `Newly failing packages:
+  p
+Disappeared tests:
+  p TestA
+`
+	if s := buf.String(); s != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, s)
+	}
+
+	// Disappeared tests fail the diff if requested.
+	oldRun = events(t, "run TestA", "pass TestA", "run TestB", "pass TestB", "pass ")
+	newRun = events(t, "run TestA", "pass TestA", "pass ")
+	buf.Reset()
+	if err := diff(strings.NewReader(oldRun), strings.NewReader(newRun), &buf, diffOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = diff(strings.NewReader(oldRun), strings.NewReader(newRun), &buf, diffOptions{FailDisappeared: true})
+	if err == nil || err.Error() != "1 disappeared tests" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
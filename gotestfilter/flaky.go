@@ -0,0 +1,132 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type flakyIteration struct {
+	// Iteration is the 1-based index of the run of the test.
+	Iteration    int    `json:"iteration"`
+	Unterminated bool   `json:"unterminated,omitempty"`
+	Output       string `json:"output"`
+}
+
+type flakyTest struct {
+	Package     string           `json:"package"`
+	Test        string           `json:"test"`
+	Runs        int              `json:"runs"`
+	Passes      int              `json:"passes"`
+	Failures    int              `json:"failures"`
+	Skips       int              `json:"skips"`
+	FailureRate float64          `json:"failure_rate"`
+	Failed      []flakyIteration `json:"failed_iterations"`
+
+	running bool
+	output  *capBuffer // of the current iteration
+}
+
+type flakyReport struct {
+	// Tests is the number of distinct tests (including subtests) seen.
+	Tests int `json:"tests"`
+	// Flaky lists the tests that both passed and failed, in the order in
+	// which they first ran.
+	Flaky []*flakyTest `json:"flaky"`
+	// Failing lists the tests that failed in every iteration they didn't
+	// skip.
+	Failing []string `json:"failing"`
+}
+
+// flaky aggregates the results of repeated runs of the same tests (as with
+// go test -count=N) and writes a JSON report of the tests with mixed
+// outcomes, including the output of each failing iteration. Iterations that
+// never terminated (because the test binary exited prematurely) count as
+// failures.
+func flaky(in io.Reader, out io.Writer, sum *summary) error {
+	var tests []*flakyTest
+	byKey := map[tup]*flakyTest{}
+	if err := scanEvents(in, func(line string, ev *testEvent) error {
+		sum.observe(ev)
+		if ev.Test == "" {
+			return nil
+		}
+		key := tup{ev.Package, ev.Test}
+		ft := byKey[key]
+		if ft == nil {
+			ft = &flakyTest{Package: ev.Package, Test: ev.Test, output: newCapBuffer()}
+			byKey[key] = ft
+			tests = append(tests, ft)
+		}
+		switch ev.Action {
+		case "run":
+			ft.endUnterminated()
+			ft.running = true
+			ft.Runs++
+			ft.output.release()
+		case "output":
+			return ft.output.add(ev.Output)
+		case "pass":
+			ft.Passes++
+			ft.running = false
+		case "skip":
+			ft.Skips++
+			ft.running = false
+		case "fail":
+			ft.Failures++
+			ft.Failed = append(ft.Failed, flakyIteration{Iteration: ft.Runs, Output: ft.output.String()})
+			ft.running = false
+		case "pause", "cont", "bench":
+			return nil
+		default:
+			return fmt.Errorf("unknown input: %s", line)
+		}
+		if !ft.running {
+			ft.output.release()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	report := flakyReport{Tests: len(tests), Flaky: []*flakyTest{}, Failing: []string{}}
+	for _, ft := range tests {
+		ft.endUnterminated()
+		if ft.Failures == 0 {
+			continue
+		}
+		if ft.Passes == 0 {
+			report.Failing = append(report.Failing, ft.Package+" "+ft.Test)
+			continue
+		}
+		ft.FailureRate = float64(ft.Failures) / float64(ft.Failures+ft.Passes)
+		report.Flaky = append(report.Flaky, ft)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// endUnterminated records a failure if the current iteration of the test
+// never terminated.
+func (ft *flakyTest) endUnterminated() {
+	if !ft.running {
+		return
+	}
+	ft.running = false
+	ft.Failures++
+	ft.Failed = append(ft.Failed, flakyIteration{
+		Iteration: ft.Runs, Unterminated: true, Output: ft.output.String(),
+	})
+	ft.output.release()
+}
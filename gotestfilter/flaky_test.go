@@ -0,0 +1,76 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func runFlaky(t *testing.T, in io.Reader) flakyReport {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := flaky(in, &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	var report flakyReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestFlaky(t *testing.T) {
+	f, err := os.Open("testdata/flaky.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	report := runFlaky(t, f)
+	if report.Tests != 2 || len(report.Flaky) != 1 || len(report.Failing) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	ft := report.Flaky[0]
+	if ft.Test != "TestFlaky" || ft.Runs != 3 || ft.Passes != 2 || ft.Failures != 1 {
+		t.Fatalf("unexpected test: %+v", ft)
+	}
+	if len(ft.Failed) != 1 || ft.Failed[0].Iteration != 2 ||
+		!strings.Contains(ft.Failed[0].Output, "unlucky") {
+		t.Fatalf("unexpected failed iterations: %+v", ft.Failed)
+	}
+}
+
+func TestFlakyUnterminated(t *testing.T) {
+	report := runFlaky(t, strings.NewReader(events(t,
+		"run TestA",
+		"pass TestA",
+		"run TestB",
+		"fail TestB",
+		"run TestA",
+		"output TestA hanging",
+		"run TestB",
+		"fail TestB",
+	)))
+	if len(report.Flaky) != 1 || strings.Join(report.Failing, ",") != "p TestB" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	ft := report.Flaky[0]
+	if ft.FailureRate != 0.5 || len(ft.Failed) != 1 {
+		t.Fatalf("unexpected test: %+v", ft)
+	}
+	if it := ft.Failed[0]; it.Iteration != 2 || !it.Unterminated || it.Output != "hanging\n" {
+		t.Fatalf("unexpected iteration: %+v", it)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/tbg/goplay/gotestfilter
+
+go 1.21
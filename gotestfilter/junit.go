@@ -0,0 +1,180 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type junitTestSuites struct {
+	XMLName xml.Name          `xml:"testsuites"`
+	Suites  []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Cases    []*junitTestCase `xml:"testcase"`
+
+	elapsed float64 // from the package's pass/fail event, if any
+}
+
+type junitTestCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+
+	done    bool
+	elapsed float64
+	output  *capBuffer // released once done
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",cdata"`
+}
+
+func newJUnitMessage(msg, output string) *junitMessage {
+	return &junitMessage{Message: msg, Output: strings.Map(xmlChar, output)}
+}
+
+// xmlChar replaces runes that can't appear in an XML document (test output
+// may contain terminal escape sequences, for example).
+func xmlChar(r rune) rune {
+	if r == '\t' || r == '\n' || r == '\r' ||
+		(r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0x10FFFF) {
+		return r
+	}
+	return '\uFFFD'
+}
+
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+// junit converts test2json output to a JUnit XML report. Suites and test
+// cases appear in the order in which they first show up in the input. Like
+// filter, it returns an error if any test did not terminate, but it still
+// writes the report, with such tests marked as errors. A package that failed
+// without a failing or unterminated test (due to a build failure, for
+// example) is reported as an error of a synthetic test case holding the
+// package output, and also results in an error.
+func junit(in io.Reader, out io.Writer, sum *summary) error {
+	var suites junitTestSuites
+	suiteByPkg := map[string]*junitTestSuite{}
+	pkgs := map[string]*pkg{}
+	caseByKey := map[tup]*junitTestCase{}
+	if err := scanEvents(in, func(line string, ev *testEvent) error {
+		sum.observe(ev)
+		suite := suiteByPkg[ev.Package]
+		if suite == nil {
+			suite = &junitTestSuite{Name: ev.Package}
+			suiteByPkg[ev.Package] = suite
+			pkgs[ev.Package] = &pkg{name: ev.Package}
+			suites.Suites = append(suites.Suites, suite)
+		}
+		if ev.Test == "" {
+			pkgs[ev.Package].add(line, ev)
+			if ev.Action == "pass" || ev.Action == "fail" {
+				suite.elapsed = ev.Elapsed
+			}
+			return nil
+		}
+		key := tup{ev.Package, ev.Test}
+		tc := caseByKey[key]
+		if tc == nil {
+			tc = &junitTestCase{Classname: ev.Package, Name: ev.Test, output: newCapBuffer()}
+			caseByKey[key] = tc
+			suite.Cases = append(suite.Cases, tc)
+		}
+		switch ev.Action {
+		case "output":
+			return tc.output.add(ev.Output)
+		case "pass", "skip", "fail":
+			tc.done = true
+			tc.elapsed = ev.Elapsed
+			if ev.Action == "fail" {
+				tc.Failure = newJUnitMessage("Failed", tc.output.String())
+			} else if ev.Action == "skip" {
+				tc.Skipped = newJUnitMessage("Skipped", tc.output.String())
+			}
+			tc.output.release()
+		case "run", "pause", "cont", "bench":
+		default:
+			return fmt.Errorf("unknown input: %s", line)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var unterminated, failedPkgs int
+	for _, suite := range suites.Suites {
+		var sum float64
+		var explained bool // by a failed or unterminated test
+		for _, tc := range suite.Cases {
+			if !tc.done {
+				unterminated++
+				tc.Error = newJUnitMessage("test did not terminate", tc.output.String())
+				tc.output.release()
+			}
+			explained = explained || tc.Failure != nil || tc.Error != nil
+		}
+		if p := pkgs[suite.Name]; p.failed && !explained {
+			failedPkgs++
+			suite.Cases = append(suite.Cases, &junitTestCase{
+				Classname: suite.Name,
+				Name:      packageTestName,
+				Error:     newJUnitMessage(p.failureMessage(), p.output()),
+			})
+		}
+		for _, tc := range suite.Cases {
+			suite.Tests++
+			switch {
+			case tc.Failure != nil:
+				suite.Failures++
+			case tc.Error != nil:
+				suite.Errors++
+			case tc.Skipped != nil:
+				suite.Skipped++
+			}
+			tc.Time = junitTime(tc.elapsed)
+			sum += tc.elapsed
+		}
+		if suite.elapsed == 0 {
+			suite.elapsed = sum
+		}
+		suite.Time = junitTime(suite.elapsed)
+	}
+
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "\t")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(out); err != nil {
+		return err
+	}
+	return packageErr(unterminated, failedPkgs)
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"strings"
+	"testing"
+)
+
+func runJUnit(t *testing.T, file string) (junitTestSuites, error) {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	runErr := junit(f, &buf, nil)
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	return suites, runErr
+}
+
+func TestJUnit(t *testing.T) {
+	suites, err := runJUnit(t, "testdata/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suites.Suites) != 2 {
+		t.Fatalf("expected 2 suites, got %d", len(suites.Suites))
+	}
+	a := suites.Suites[0]
+	if a.Name != "example.com/sample/a" || a.Tests != 6 || a.Failures != 3 || a.Skipped != 1 || a.Errors != 0 {
+		t.Errorf("unexpected suite: %+v", a)
+	}
+	if a.Time != "0.005" {
+		t.Errorf("expected package elapsed time, got %s", a.Time)
+	}
+	for _, tc := range a.Cases {
+		switch tc.Name {
+		case "TestFail":
+			if tc.Failure == nil || !strings.Contains(tc.Failure.Output, "a_test.go:11: boom\n") {
+				t.Errorf("expected failure output, got %+v", tc.Failure)
+			}
+		case "TestSkip":
+			if tc.Skipped == nil || !strings.Contains(tc.Skipped.Output, "not today") {
+				t.Errorf("expected skip output, got %+v", tc.Skipped)
+			}
+		case "TestPass":
+			if tc.Failure != nil || tc.Skipped != nil || tc.Error != nil {
+				t.Errorf("unexpected result for passing test: %+v", tc)
+			}
+		}
+	}
+}
+
+func TestJUnitUnterminated(t *testing.T) {
+	suites, err := runJUnit(t, "testdata/unterminated.json")
+	if err == nil || !strings.Contains(err.Error(), "1 tests did not terminate") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := suites.Suites[0]
+	if s.Tests != 2 || s.Errors != 1 {
+		t.Fatalf("unexpected suite: %+v", s)
+	}
+	tc := s.Cases[1]
+	if tc.Name != "TestHang" || tc.Error == nil || !strings.Contains(tc.Error.Output, "waiting for Godot") {
+		t.Fatalf("unexpected test case: %+v", tc)
+	}
+	if s.Cases[0].Time != "1.500" {
+		t.Fatalf("unexpected elapsed time: %s", s.Cases[0].Time)
+	}
+}
+
+func TestJUnitPackageFailure(t *testing.T) {
+	var buf bytes.Buffer
+	err := junit(strings.NewReader(events(t,
+		"output  panic: boom in init",
+		"fail ",
+	)), &buf, nil)
+	if err == nil || !strings.Contains(err.Error(), "1 packages failed without a failing test") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+	s := suites.Suites[0]
+	if s.Tests != 1 || s.Errors != 1 {
+		t.Fatalf("unexpected suite: %+v", s)
+	}
+	tc := s.Cases[0]
+	if tc.Name != packageTestName || tc.Error == nil || tc.Error.Message != "panic: boom in init" ||
+		tc.Error.Output != "panic: boom in init\n" {
+		t.Fatalf("unexpected test case: %+v", tc)
+	}
+}
+
+func TestXMLChar(t *testing.T) {
+	if s := strings.Map(xmlChar, "\x1b[31mred\x1b[0m\n"); s != "�[31mred�[0m\n" {
+		t.Fatalf("unexpected result: %q", s)
+	}
+}
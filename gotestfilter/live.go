@@ -0,0 +1,267 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// liveRefresh is the interval at which the status of the live mode is
+// redrawn.
+const liveRefresh = 250 * time.Millisecond
+
+// liveMaxRunning is the maximum number of running tests listed in the
+// status of the live mode.
+const liveMaxRunning = 10
+
+// isTerminal returns whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// A liveWriter prints the results of tests as they terminate, including the
+// full output of failed tests, and the results of packages, including the
+// package output of failed ones (which explains build failures and panics
+// outside of tests). On a terminal, passing and skipped tests are
+// only counted, and a status listing the running tests is kept at the bottom
+// of the output. Otherwise, there is a line for each test.
+type liveWriter struct {
+	out io.Writer
+	tty bool
+	now func() time.Time
+
+	mu         sync.Mutex
+	err        error
+	finished   bool
+	statusLen  int // number of status lines currently displayed
+	running    map[tup]time.Time
+	output     map[tup]*capBuffer
+	pkgs       map[string]*pkg // until they terminate
+	pass, fail int
+	skip       int
+}
+
+func newLiveWriter(out io.Writer, tty bool, now func() time.Time) *liveWriter {
+	return &liveWriter{
+		out:     out,
+		tty:     tty,
+		now:     now,
+		running: map[tup]time.Time{},
+		output:  map[tup]*capBuffer{},
+		pkgs:    map[string]*pkg{},
+	}
+}
+
+// printf prints a line above the status.
+func (lw *liveWriter) printf(format string, args ...interface{}) {
+	if lw.err != nil {
+		return
+	}
+	_, lw.err = fmt.Fprintf(lw.out, format, args...)
+}
+
+func (lw *liveWriter) clearStatus() {
+	if lw.statusLen > 0 {
+		// Move to the start of the first status line and clear from there.
+		lw.printf("\x1b[%dF\x1b[J", lw.statusLen)
+		lw.statusLen = 0
+	}
+}
+
+func (lw *liveWriter) drawStatus() {
+	if !lw.tty {
+		return
+	}
+	now := lw.now()
+	type runningTest struct {
+		tup
+		elapsed time.Duration
+	}
+	running := make([]runningTest, 0, len(lw.running))
+	for key, start := range lw.running {
+		running = append(running, runningTest{key, now.Sub(start)})
+	}
+	sort.Slice(running, func(i, j int) bool {
+		if running[i].elapsed != running[j].elapsed {
+			return running[i].elapsed > running[j].elapsed
+		}
+		if running[i].pkg != running[j].pkg {
+			return running[i].pkg < running[j].pkg
+		}
+		return running[i].test < running[j].test
+	})
+	lw.printf("=== %d running, %d passed, %d failed, %d skipped\n",
+		len(running), lw.pass, lw.fail, lw.skip)
+	lw.statusLen = 1
+	for i, r := range running {
+		if i == liveMaxRunning {
+			lw.printf("    ... and %d more\n", len(running)-i)
+			lw.statusLen++
+			break
+		}
+		lw.printf("    %6.1fs %s %s\n", r.elapsed.Seconds(), r.pkg, r.test)
+		lw.statusLen++
+	}
+}
+
+// refresh redraws the status.
+func (lw *liveWriter) refresh() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if !lw.tty || lw.finished {
+		return
+	}
+	lw.clearStatus()
+	lw.drawStatus()
+}
+
+// observe processes the event, decoded from the given line.
+func (lw *liveWriter) observe(line string, ev *testEvent) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.clearStatus()
+	defer lw.drawStatus()
+
+	if ev.Test == "" {
+		p := lw.pkgs[ev.Package]
+		if p == nil {
+			p = &pkg{name: ev.Package}
+			lw.pkgs[ev.Package] = p
+		}
+		p.add(line, ev)
+		switch ev.Action {
+		case "pass":
+			lw.printf("ok   %s %.3fs\n", ev.Package, ev.Elapsed)
+		case "fail":
+			lw.printf("FAIL %s %.3fs\n", ev.Package, ev.Elapsed)
+			lw.printf("%s", p.output())
+		}
+		if p.done {
+			delete(lw.pkgs, ev.Package)
+		}
+		return
+	}
+	key := tup{ev.Package, ev.Test}
+	switch ev.Action {
+	case "run":
+		lw.running[key] = lw.now()
+		lw.output[key] = newCapBuffer()
+	case "output":
+		if b := lw.output[key]; b != nil && lw.err == nil {
+			lw.err = b.add(ev.Output)
+		}
+	case "pass", "skip", "fail":
+		output := lw.output[key]
+		delete(lw.running, key)
+		delete(lw.output, key)
+		switch ev.Action {
+		case "pass":
+			lw.pass++
+			if !lw.tty {
+				lw.printf("--- PASS: %s %s (%.2fs)\n", ev.Package, ev.Test, ev.Elapsed)
+			}
+		case "skip":
+			lw.skip++
+			if !lw.tty {
+				lw.printf("--- SKIP: %s %s (%.2fs)\n", ev.Package, ev.Test, ev.Elapsed)
+			}
+		case "fail":
+			lw.fail++
+			lw.printf("--- FAIL: %s %s (%.2fs)\n", ev.Package, ev.Test, ev.Elapsed)
+			if output != nil && lw.err == nil {
+				lw.err = output.writeTo(lw.out, elisionNote)
+			}
+		}
+		if output != nil {
+			output.release()
+		}
+	}
+}
+
+// finish removes the status and prints the final counts, along with the
+// output of the tests that did not terminate. It returns the number of such
+// tests.
+func (lw *liveWriter) finish() (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.finished = true
+	lw.clearStatus()
+	keys := make([]tup, 0, len(lw.running))
+	for key := range lw.running {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ti, tj := lw.running[keys[i]], lw.running[keys[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		if keys[i].pkg != keys[j].pkg {
+			return keys[i].pkg < keys[j].pkg
+		}
+		return keys[i].test < keys[j].test
+	})
+	for _, key := range keys {
+		lw.printf("--- UNTERMINATED: %s %s\n", key.pkg, key.test)
+		if lw.err == nil {
+			lw.err = lw.output[key].writeTo(lw.out, elisionNote)
+		}
+		lw.output[key].release()
+	}
+	lw.printf("=== %d passed, %d failed, %d skipped\n", lw.pass, lw.fail, lw.skip)
+	return len(keys), lw.err
+}
+
+// live prints test results as they happen, see liveWriter. On a terminal,
+// the status is redrawn periodically even if no events arrive.
+func live(in io.Reader, out io.Writer, sum *summary) error {
+	lw := newLiveWriter(out, isTerminal(out), time.Now)
+	if lw.tty {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			t := time.NewTicker(liveRefresh)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					lw.refresh()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	if err := scanEvents(in, func(line string, ev *testEvent) error {
+		sum.observe(ev)
+		lw.observe(line, ev)
+		return nil
+	}); err != nil {
+		return err
+	}
+	n, err := lw.finish()
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		return fmt.Errorf("%d tests did not terminate (a package likely exited prematurely)", n)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLive(t *testing.T) {
+	in := events(t,
+		"run TestA",
+		"run TestB",
+		"output TestA all good",
+		"pass TestA",
+		"output TestB boom",
+		"fail TestB",
+		"run TestC",
+		"output TestC stuck",
+	)
+
+	t.Run("plain", func(t *testing.T) {
+		var buf strings.Builder
+		err := live(strings.NewReader(in), &buf, nil)
+		if err == nil || !strings.Contains(err.Error(), "1 tests did not terminate") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		const exp = `--- PASS: p TestA (0.00s)
+--- FAIL: p TestB (0.00s)
+boom
+--- UNTERMINATED: p TestC
+stuck
+=== 1 passed, 1 failed, 0 skipped
+`
+		if s := buf.String(); s != exp {
+			t.Fatalf("expected:\n%s\ngot:\n%s", exp, s)
+		}
+	})
+
+	t.Run("tty", func(t *testing.T) {
+		now := time.Unix(0, 0)
+		var buf strings.Builder
+		lw := newLiveWriter(&buf, true /* tty */, func() time.Time { return now })
+		var lines []string
+		var evs []testEvent
+		if err := scanEvents(strings.NewReader(in), func(line string, ev *testEvent) error {
+			lines = append(lines, line)
+			evs = append(evs, *ev)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		lw.observe(lines[0], &evs[0]) // run TestA
+		now = now.Add(time.Second)
+		lw.observe(lines[1], &evs[1]) // run TestB
+		now = now.Add(time.Second)
+		buf.Reset()
+		lw.refresh()
+		const clear = "\x1b[3F\x1b[J"
+		if exp, s := clear+`=== 2 running, 0 passed, 0 failed, 0 skipped
+       2.0s p TestA
+       1.0s p TestB
+`, buf.String(); s != exp {
+			t.Fatalf("expected:\n%q\ngot:\n%q", exp, s)
+		}
+
+		// Passing tests are only counted, but failures are printed above
+		// the status.
+		buf.Reset()
+		for i := range evs[2:6] {
+			lw.observe(lines[2+i], &evs[2+i])
+		}
+		if exp, s := "\x1b[2F\x1b[J--- FAIL: p TestB (0.00s)\nboom\n"+
+			"=== 0 running, 1 passed, 1 failed, 0 skipped\n", buf.String(); !strings.HasSuffix(s, exp) {
+			t.Fatalf("expected suffix:\n%q\ngot:\n%q", exp, s)
+		}
+		if strings.Contains(buf.String(), "PASS") {
+			t.Fatalf("unexpected output for passing test:\n%q", buf.String())
+		}
+	})
+}
+
+func TestLivePackageFailure(t *testing.T) {
+	in := events(t,
+		"output  p/a_test.go:3:2: undefined: x",
+		"output  FAIL\tp [build failed]",
+		"fail ",
+	)
+	var buf strings.Builder
+	if err := live(strings.NewReader(in), &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	const exp = `FAIL p 0.000s
+p/a_test.go:3:2: undefined: x
+FAIL	p [build failed]
+=== 0 passed, 0 failed, 0 skipped
+`
+	if s := buf.String(); s != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, s)
+	}
+}
@@ -17,51 +17,143 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"strings"
+	"regexp"
+	"sort"
 	"time"
 )
 
 const modeUsage = `strip:
-  omit output for non-failing tests, but print run/pass/skip events for all tests
+  omit output for non-failing tests, but print run/pass/skip events for all tests,
+  collapsing passing subtrees into their top-level test
 omit:
-  only emit failing tests
+  only emit failing tests (along with their failing subtests)
 convert:
   don't perform any filtering, simply convert the json back to original test format'
+junit:
+  emit a JUnit XML report, with output attached to failed, skipped and unterminated tests
+flaky:
+  aggregate the results of repeated runs (go test -count=N) and emit a JSON report of
+  the tests that both passed and failed
+live:
+  print test results and the output of failed tests as they happen; on a terminal, show
+  the running tests in a continuously updated status instead of a line per passing test
+github:
+  print the output of failed tests in collapsible groups along with GitHub Actions error
+  annotations for the file locations found in it (see -module)
+teamcity:
+  emit TeamCity service messages reporting each test, with the output of failed tests
 `
 
 var mode = flag.String("mode", "strip", modeUsage)
 
+var summaryFile = flag.String("summary", "",
+	"if set, write a summary of the test results to this file (- for stderr)")
+var slowest = flag.Int("slowest", 10, "number of slowest tests to list in the summary")
+
 type testEvent struct {
 	Time    time.Time // encodes as an RFC3339-format string
 	Action  string
 	Package string
-	Test    string
-	Elapsed float64 // seconds
-	Output  string
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"` // seconds
+	Output  string  `json:",omitempty"`
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %[1]s [options] < go-test.json\n"+
+			"       %[1]s diff [options] old.json new.json\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	if err := filter(os.Stdin, os.Stdout); err != nil {
+	if err := compileFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if flag.Arg(0) == "diff" {
+		if err := runDiff(flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	run := filter
+	switch *mode {
+	case "junit":
+		run = junit
+	case "flaky":
+		run = flaky
+	case "live":
+		run = live
+	case "github":
+		run = github
+	case "teamcity":
+		run = teamcity
+	}
+	var sum *summary
+	if *summaryFile != "" {
+		sum = newSummary()
+	}
+	err := run(os.Stdin, os.Stdout, sum)
+	if sum != nil {
+		// Write the summary even if the run failed, since that's when it's
+		// most useful.
+		if serr := writeSummary(sum); err == nil {
+			err = serr
+		}
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func filter(in io.Reader, out io.Writer) error {
-	scanner := bufio.NewScanner(in)
-	type tup struct {
-		pkg  string
-		test string
+// compileFlags checks the flags and compiles the regexps given by them.
+func compileFlags() error {
+	if *slowest < 0 {
+		return fmt.Errorf("-slowest must not be negative, got %d", *slowest)
 	}
-	type ent struct {
-		first, last     string // RUN and (SKIP|PASS|FAIL)
-		strings.Builder        // output
+	var err error
+	sel, err = newSelector(*includePkg, *excludePkg, *includeTest, *excludeTest)
+	if err != nil {
+		return err
+	}
+	if *grep != "" {
+		if grepRE, err = regexp.Compile(*grep); err != nil {
+			return fmt.Errorf("-grep: %w", err)
+		}
 	}
-	m := map[tup]*ent{}
+	return nil
+}
+
+func writeSummary(sum *summary) error {
+	if *summaryFile == "-" {
+		return sum.write(os.Stderr, *slowest)
+	}
+	f, err := os.Create(*summaryFile)
+	if err != nil {
+		return err
+	}
+	if err := sum.write(f, *slowest); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// scanEvents calls fn for each test2json event read from in, along with the
+// line it was decoded from. Lines that aren't test2json output, and events
+// not selected by sel, are skipped. The event is reused across calls.
+func scanEvents(in io.Reader, fn func(line string, ev *testEvent) error) error {
+	r := bufio.NewReaderSize(in, 64<<10)
 	ev := &testEvent{}
-	for scanner.Scan() {
-		line := scanner.Text() // has no EOL marker
+	for {
+		line, err := readLine(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
 		if len(line) <= 2 || line[0] != '{' || line[len(line)-1] != '}' {
 			// Not test2json output.
 			continue
@@ -70,62 +162,136 @@ func filter(in io.Reader, out io.Writer) error {
 		if err := json.Unmarshal([]byte(line), ev); err != nil {
 			return err
 		}
+		if !sel.match(ev) {
+			continue
+		}
+		if err := fn(line, ev); err != nil {
+			return err
+		}
+	}
+}
 
+type tup struct {
+	pkg  string
+	test string
+}
+
+func filter(in io.Reader, out io.Writer, sum *summary) error {
+	m := map[tup]*tree{} // by top-level test
+	pkgs := map[string]*pkg{}
+	var seq int
+	var n int // unterminated tests
+	// openTrees returns the unterminated trees of the given package, in the
+	// order in which they were started.
+	openTrees := func(p *pkg) []*tree {
+		var trees []*tree
+		for key, t := range m {
+			if key.pkg == p.name {
+				trees = append(trees, t)
+			}
+		}
+		sort.Slice(trees, func(i, j int) bool { return trees[i].seq < trees[j].seq })
+		return trees
+	}
+	// reportFailure reports the failure of the package, see
+	// pkg.reportFailure, and forgets about the trees that were reported.
+	reportFailure := func(p *pkg) error {
+		reported, failed, err := p.reportFailure(out, openTrees(p))
+		for _, t := range reported {
+			delete(m, tup{p.name, t.name})
+		}
+		n += failed
+		return err
+	}
+	if err := scanEvents(in, func(line string, ev *testEvent) error {
+		sum.observe(ev)
 		if *mode == "convert" {
 			if ev.Action == "output" {
 				fmt.Fprint(out, ev.Output)
 			}
-			continue
+			return nil
 		}
 
+		p := pkgs[ev.Package]
+		if p == nil {
+			p = &pkg{name: ev.Package}
+			pkgs[ev.Package] = p
+		}
+		p.time = ev.Time
 		if ev.Test == "" {
-			// Skip all package output. Unfortunately package events aren't
-			// always well-formed. For example, if a test panics, the package
-			// will never receive a fail event (arguably a bug), so it's not
-			// trivial to print only failing packages. Besides, there's not much
-			// package output typically (only init functions), so not worth
-			// getting fancy about.
-			continue
+			// Package events aren't always well-formed. For example, if a
+			// test panics, older versions of go test never send a fail event
+			// for it (and sometimes not for the package either), so package
+			// output is only printed when it explains a failure.
+			p.add(line, ev)
+			if ev.Action != "fail" {
+				return nil
+			}
+			return reportFailure(p)
+		}
+		switch ev.Action {
+		case "run", "pause", "cont", "bench", "output", "pass", "skip", "fail":
+		default:
+			// We must have parsed some JSON that wasn't a testData.
+			return fmt.Errorf("unknown input: %s", line)
 		}
-		key := tup{ev.Package, ev.Test}
-		buf := m[key]
-		if buf == nil {
-			buf = &ent{first: line}
-			m[key] = buf
+		root := rootName(ev.Test)
+		key := tup{ev.Package, root}
+		t := m[key]
+		if t == nil {
+			seq++
+			t = newTree(seq, ev.Package, root)
+			m[key] = t
 		}
-		if _, err := fmt.Fprintln(buf, line); err != nil {
+		if err := t.add(ev.Test, line, ev); err != nil {
 			return err
 		}
-		switch ev.Action {
-		case "pass", "skip", "fail":
-			buf.last = line
+		if ev.Test == root && t.root.done {
 			delete(m, key)
-			if ev.Action == "fail" {
-				fmt.Fprint(out, buf.String())
-			} else if *mode == "strip" {
-				// Output only the start and end of test so that we preserve the
-				// timing information. However, the output is omitted.
-				fmt.Fprintln(out, buf.first)
-				fmt.Fprintln(out, buf.last)
+			if t.root.failed {
+				p.failedTest = true
 			}
-		case "run", "pause", "cont", "bench", "output":
-		default:
-			// We must have parsed some JSON that wasn't a testData.
-			return fmt.Errorf("unknown input: %s", line)
+			// Output only the start and end of passing tests so that we
+			// preserve the timing information. However, the output is
+			// omitted, unless it matched grepRE.
+			return t.write(out, *mode == "strip", t.matched /* all */)
 		}
+		return nil
+	}); err != nil {
+		return err
 	}
-	// Some scopes might still be open. To the best of my knowledge, this is due
-	// to a panic/premature exit of a test binary. In that case, it seems that
-	// neither is the package scope closed, nor the scopes for any tests that
-	// were running in parallel, so we pass that through if stripping, but not
-	// when omitting.
-	if *mode == "strip" {
-		for key := range m {
-			fmt.Fprintln(out, m[key].String())
-		}
+	// Some scopes might still be open. This is due to a premature exit of a
+	// test binary. If the package never received a fail event, report them as
+	// if it had. The ones the failure isn't attributed to weren't to blame
+	// (they may have been paused parallel tests, for example), so we pass them
+	// through if stripping, but not when omitting. Either way, like the ones
+	// that were reported, they didn't terminate.
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
 	}
-	if n := len(m); n != 0 {
-		return fmt.Errorf("%d tests did not terminate (a package likely exited prematurely)", n)
+	sort.Strings(names)
+	for _, name := range names {
+		p := pkgs[name]
+		if len(openTrees(p)) == 0 {
+			continue
+		}
+		if !p.done {
+			if err := reportFailure(p); err != nil {
+				return err
+			}
+		}
+		trees := openTrees(p)
+		for _, t := range trees {
+			n += t.unterminated()
+		}
+		if *mode == "strip" {
+			for _, t := range trees {
+				if err := t.write(out, true /* strip */, true /* all */); err != nil {
+					return err
+				}
+			}
+		}
 	}
-	return nil
+	return packageErr(n, 0)
 }
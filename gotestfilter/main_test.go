@@ -0,0 +1,307 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// events returns test2json output for the given events, each of which is
+// "<action> <test> [<output>]".
+func events(t *testing.T, evs ...string) string {
+	t.Helper()
+	var buf strings.Builder
+	for _, s := range evs {
+		f := strings.SplitN(s, " ", 3)
+		ev := testEvent{Action: f[0], Package: "p", Test: f[1]}
+		if len(f) == 3 {
+			ev.Output = f[2] + "\n"
+		}
+		b, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// runFilter runs filter in the given mode and returns the output in the
+// format accepted by events.
+func runFilter(t *testing.T, m string, in string) ([]string, error) {
+	t.Helper()
+	defer func(prev string) { *mode = prev }(*mode)
+	*mode = m
+	var buf strings.Builder
+	runErr := filter(strings.NewReader(in), &buf, nil)
+	var res []string
+	if err := scanEvents(strings.NewReader(buf.String()), func(_ string, ev *testEvent) error {
+		s := fmt.Sprintf("%s %s", ev.Action, ev.Test)
+		if ev.Output != "" {
+			s += " " + strings.TrimSuffix(ev.Output, "\n")
+		}
+		res = append(res, s)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return res, runErr
+}
+
+func requireEqual(t *testing.T, exp, act []string) {
+	t.Helper()
+	if strings.Join(exp, "\n") != strings.Join(act, "\n") {
+		t.Fatalf("expected:\n%s\n\ngot:\n%s", strings.Join(exp, "\n"), strings.Join(act, "\n"))
+	}
+}
+
+func TestCompileFlags(t *testing.T) {
+	defer func(prev int) { *slowest = prev }(*slowest)
+	*slowest = -1
+	if err := compileFlags(); err == nil || err.Error() != "-slowest must not be negative, got -1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	*slowest = 0
+	if err := compileFlags(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterSubtests(t *testing.T) {
+	in := events(t,
+		"run TestA",
+		"output TestA setup A",
+		"run TestA/x",
+		"output TestA/x noise",
+		"run TestA/x/deep",
+		"pass TestA/x/deep",
+		"pass TestA/x",
+		"pass TestA",
+		"run TestB",
+		"output TestB setup B",
+		"run TestB/ok",
+		"run TestB/ok/deep",
+		"pass TestB/ok/deep",
+		"pass TestB/ok",
+		"run TestB/bad",
+		"output TestB/bad boom",
+		"fail TestB/bad",
+		"output TestB teardown B",
+		"fail TestB",
+	)
+
+	t.Run("strip", func(t *testing.T) {
+		out, err := runFilter(t, "strip", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requireEqual(t, []string{
+			// The passing subtree collapses into its top-level test.
+			"run TestA",
+			"pass TestA",
+			// The failing subtest comes with the context of its parent, and
+			// its passing sibling is collapsed.
+			"run TestB",
+			"output TestB setup B",
+			"run TestB/ok",
+			"pass TestB/ok",
+			"run TestB/bad",
+			"output TestB/bad boom",
+			"fail TestB/bad",
+			"output TestB teardown B",
+			"fail TestB",
+		}, out)
+	})
+
+	t.Run("omit", func(t *testing.T) {
+		out, err := runFilter(t, "omit", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requireEqual(t, []string{
+			"run TestB",
+			"output TestB setup B",
+			"run TestB/bad",
+			"output TestB/bad boom",
+			"fail TestB/bad",
+			"output TestB teardown B",
+			"fail TestB",
+		}, out)
+	})
+}
+
+func TestFilterUnterminated(t *testing.T) {
+	in := events(t,
+		"run TestA",
+		"run TestA/x",
+		"output TestA/x stuck",
+	)
+	out, err := runFilter(t, "strip", in)
+	if err == nil || err.Error() != "2 tests did not terminate (a package likely exited prematurely)" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	requireEqual(t, []string{
+		"run TestA",
+		"run TestA/x",
+		"output TestA/x stuck",
+		"output TestA/x --- FAIL: TestA/x (test binary exited prematurely)",
+		"fail TestA/x",
+		"output TestA --- FAIL: TestA (test binary exited prematurely)",
+		"fail TestA",
+	}, out)
+}
+
+func TestFilterPackageFailure(t *testing.T) {
+	for _, m := range []string{"strip", "omit"} {
+		t.Run(m, func(t *testing.T) {
+			// TestB was running when the test binary timed out, but TestA
+			// and its subtest were paused.
+			in := events(t,
+				"run TestA",
+				"run TestA/par",
+				"pause TestA/par",
+				"run TestB",
+				"output TestB waiting",
+				"output  panic: test timed out after 10m0s",
+				"output  running tests:",
+				"output  \tTestB (10m0s)",
+				"output  goroutine 1 [running]:",
+				"fail ",
+			)
+			out, err := runFilter(t, m, in)
+			// TestB was reported, but didn't terminate either.
+			if err == nil || !strings.Contains(err.Error(), "3 tests did not terminate") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			exp := []string{
+				"run TestB",
+				"output TestB waiting",
+				"output  panic: test timed out after 10m0s",
+				"output  running tests:",
+				"output  \tTestB (10m0s)",
+				"output  goroutine 1 [running]:",
+				"output TestB --- FAIL: TestB (panic: test timed out after 10m0s)",
+				"fail TestB",
+			}
+			if m == "strip" {
+				// TestA was not blamed, so it is only passed through at the
+				// end.
+				exp = append(exp,
+					"run TestA",
+					"run TestA/par",
+					"pause TestA/par",
+				)
+			}
+			requireEqual(t, exp, out)
+		})
+	}
+}
+
+func TestFilterTimeout(t *testing.T) {
+	// All modes exit with an error for a test that timed out, including
+	// those that report it as failed.
+	in := events(t,
+		"run TestSlow",
+		"output TestSlow waiting",
+		"output  panic: test timed out after 1m0s",
+		"output  running tests:",
+		"output  \tTestSlow (1m0s)",
+		"fail ",
+	)
+	for _, m := range []string{"strip", "omit"} {
+		t.Run(m, func(t *testing.T) {
+			out, err := runFilter(t, m, in)
+			if err == nil || err.Error() != "1 tests did not terminate (a package likely exited prematurely)" {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			requireEqual(t, []string{
+				"run TestSlow",
+				"output TestSlow waiting",
+				"output  panic: test timed out after 1m0s",
+				"output  running tests:",
+				"output  \tTestSlow (1m0s)",
+				"output TestSlow --- FAIL: TestSlow (panic: test timed out after 1m0s)",
+				"fail TestSlow",
+			}, out)
+		})
+	}
+}
+
+func TestFilterPausedParallel(t *testing.T) {
+	// A parallel test is paused when another test panics. The panic is
+	// explained by the failing test, so the paused test isn't blamed, but
+	// it didn't terminate either.
+	in := events(t,
+		"run TestPar",
+		"output TestPar === RUN   TestPar",
+		"output TestPar === PAUSE TestPar",
+		"pause TestPar",
+		"run TestPanic",
+		"output TestPanic === RUN   TestPanic",
+		"run TestPanic/sub",
+		"output TestPanic/sub === RUN   TestPanic/sub",
+		"output TestPanic/sub --- FAIL: TestPanic/sub (0.00s)",
+		"fail TestPanic/sub",
+		"output TestPanic --- FAIL: TestPanic (0.00s)",
+		"output TestPanic panic: boom [recovered]",
+		"fail TestPanic",
+		"output  FAIL\tp\t0.005s",
+		"fail ",
+	)
+	for _, m := range []string{"strip", "omit"} {
+		t.Run(m, func(t *testing.T) {
+			out, err := runFilter(t, m, in)
+			if err == nil || err.Error() != "1 tests did not terminate (a package likely exited prematurely)" {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			exp := []string{
+				"run TestPanic",
+				"output TestPanic === RUN   TestPanic",
+				"run TestPanic/sub",
+				"output TestPanic/sub === RUN   TestPanic/sub",
+				"output TestPanic/sub --- FAIL: TestPanic/sub (0.00s)",
+				"fail TestPanic/sub",
+				"output TestPanic --- FAIL: TestPanic (0.00s)",
+				"output TestPanic panic: boom [recovered]",
+				"fail TestPanic",
+			}
+			if m == "strip" {
+				exp = append(exp,
+					"run TestPar",
+					"output TestPar === RUN   TestPar",
+					"output TestPar === PAUSE TestPar",
+					"pause TestPar",
+				)
+			}
+			requireEqual(t, exp, out)
+		})
+	}
+}
+
+func TestFilterPackageOutput(t *testing.T) {
+	// A package that fails without any failing test, as with a TestMain
+	// exiting with a nonzero code, has its output printed.
+	in := events(t,
+		"run TestA",
+		"pass TestA",
+		"output  leaked goroutines",
+		"fail ",
+	)
+	out, err := runFilter(t, "omit", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireEqual(t, []string{"output  leaked goroutines"}, out)
+}
@@ -0,0 +1,243 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// packageTailLines is the number of lines of package output retained for
+// reporting a package failure.
+const packageTailLines = 50
+
+// packageTestName is the name under which modes reporting only the results of
+// tests report the failure of a package that isn't attributed to any test.
+const packageTestName = "TestMain"
+
+// A pkg tracks the package-level events of a package, which are needed to
+// make sense of a test binary that exits prematurely (due to a panic or a
+// timeout, for example). In that case, the tests that were running never
+// receive a terminating event, and the panic shows up as package output.
+type pkg struct {
+	name string
+	// time is the time of the package's latest event.
+	time time.Time
+	// tail holds the last packageTailLines package-level output events.
+	tail []string
+	// panic is the first line of package output starting with "panic: ".
+	panic string
+	// running holds the tests listed as running in the message printed on a
+	// test timeout.
+	running   []string
+	inRunning bool
+	// failedTest is set once a failing test of the package was reported.
+	failedTest bool
+	// done is set once the package terminated, and failed if it failed.
+	done, failed bool
+}
+
+// add records a package-level event.
+func (p *pkg) add(line string, ev *testEvent) {
+	switch ev.Action {
+	case "pass", "fail":
+		p.done = true
+		p.failed = ev.Action == "fail"
+		return
+	case "output":
+	default:
+		return
+	}
+	if len(p.tail) == packageTailLines {
+		copy(p.tail, p.tail[1:])
+		p.tail = p.tail[:len(p.tail)-1]
+	}
+	p.tail = append(p.tail, line)
+
+	out := strings.TrimSuffix(ev.Output, "\n")
+	switch {
+	case strings.HasPrefix(out, "panic: ") && p.panic == "":
+		p.panic = out
+	case out == "running tests:":
+		// Printed after "panic: test timed out after ...", followed by
+		// lines like "\tTestFoo (10m0s)".
+		p.inRunning = true
+	case p.inRunning && strings.HasPrefix(out, "\t"):
+		name := strings.TrimPrefix(out, "\t")
+		if i := strings.Index(name, " ("); i >= 0 {
+			name = name[:i]
+		}
+		p.running = append(p.running, name)
+	default:
+		p.inRunning = false
+	}
+}
+
+// attribute returns the trees (from the given ones of the package) that the
+// package failure is attributed to. If the package output names the running
+// tests, those are the ones. Otherwise, all tests that didn't terminate are
+// assumed to have been cut short by the failure, unless a failing test of the
+// package was reported: the failure is then explained by that test (which
+// panicked, for example), and the tests that didn't terminate may not even
+// have been running (paused parallel tests, for example).
+func (p *pkg) attribute(trees []*tree) []*tree {
+	var res []*tree
+	for _, t := range trees {
+		for _, name := range p.running {
+			if _, ok := t.nodes[name]; ok {
+				res = append(res, t)
+				break
+			}
+		}
+	}
+	if len(res) == 0 && !p.failedTest {
+		return trees
+	}
+	return res
+}
+
+// attributeTests is like attribute, for the names of the unterminated tests
+// of the package.
+func (p *pkg) attributeTests(tests []string) []string {
+	var res []string
+	for _, test := range tests {
+		for _, name := range p.running {
+			if name == test || strings.HasPrefix(name, test+"/") {
+				res = append(res, test)
+				break
+			}
+		}
+	}
+	if len(res) == 0 && !p.failedTest {
+		return tests
+	}
+	return res
+}
+
+// reason describes why the tests of the package didn't terminate.
+func (p *pkg) reason() string {
+	if p.panic != "" {
+		return p.panic
+	}
+	return "test binary exited prematurely"
+}
+
+// reportFailure prints the failure of the package which left the given trees
+// (ordered by start) without terminating events, if any. Each tree the
+// failure is attributed to is printed in full, followed by the package
+// output and synthesized events failing the unterminated tests. If no tree
+// is to blame and no failing test of the package was reported, just the
+// package output is printed, since it explains the failure (a build error,
+// for example). The trees that were reported are returned, along with the
+// number of unterminated tests that were failed.
+func (p *pkg) reportFailure(out io.Writer, trees []*tree) ([]*tree, int, error) {
+	attributed := p.attribute(trees)
+	if len(attributed) == 0 {
+		if p.failedTest {
+			return nil, 0, nil
+		}
+		return nil, 0, p.writeTail(out)
+	}
+	for _, t := range attributed {
+		if err := t.write(out, true /* strip */, true /* all */); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := p.writeTail(out); err != nil {
+		return nil, 0, err
+	}
+	var failed int
+	for _, t := range attributed {
+		n, err := p.failUnterminated(out, t)
+		if err != nil {
+			return nil, 0, err
+		}
+		failed += n
+	}
+	p.failedTest = true
+	return attributed, failed, nil
+}
+
+// output returns the package output retained in the tail.
+func (p *pkg) output() string {
+	var b strings.Builder
+	for _, line := range p.tail {
+		var ev testEvent
+		if err := json.Unmarshal([]byte(line), &ev); err == nil {
+			b.WriteString(ev.Output)
+		}
+	}
+	return b.String()
+}
+
+// failureMessage describes the failure of a package that isn't attributed to
+// any test, such as a build failure or a panic in an init function.
+func (p *pkg) failureMessage() string {
+	if p.panic != "" {
+		return p.panic
+	}
+	return "package failed"
+}
+
+// packageErr returns the error for the given numbers of tests that did not
+// terminate and of packages that failed without a failing test, if any.
+func packageErr(unterminated, failedPkgs int) error {
+	if unterminated != 0 {
+		return fmt.Errorf("%d tests did not terminate (a package likely exited prematurely)", unterminated)
+	}
+	if failedPkgs != 0 {
+		return fmt.Errorf("%d packages failed without a failing test", failedPkgs)
+	}
+	return nil
+}
+
+func (p *pkg) writeTail(out io.Writer) error {
+	for _, line := range p.tail {
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failUnterminated prints events failing the unterminated tests of the tree,
+// innermost first, as go test would have if they had failed regularly, and
+// returns their number.
+func (p *pkg) failUnterminated(out io.Writer, t *tree) (int, error) {
+	var names []string
+	for name, n := range t.nodes {
+		if !n.done {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		for _, fev := range []testEvent{
+			{Action: "output", Output: fmt.Sprintf("--- FAIL: %s (%s)\n", name, p.reason())},
+			{Action: "fail"},
+		} {
+			fev.Time, fev.Package, fev.Test = p.time, p.name, name
+			b, err := json.Marshal(fev)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := fmt.Fprintln(out, string(b)); err != nil {
+				return 0, err
+			}
+		}
+		t.nodes[name].done = true
+	}
+	return len(names), nil
+}
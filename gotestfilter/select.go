@@ -0,0 +1,164 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var includePkg = flag.String("include-pkg", "", "only consider packages matching this regexp")
+var excludePkg = flag.String("exclude-pkg", "", "ignore packages matching this regexp")
+var includeTest = flag.String("include-test", "",
+	"only consider tests matching this regexp, split by slashes into patterns for each level of "+
+		"subtests as with go test -run")
+var excludeTest = flag.String("exclude-test", "",
+	"ignore tests matching this regexp, split by slashes as with go test -skip")
+var grep = flag.String("grep", "WARNING: DATA RACE",
+	"in strip and omit modes, print passing tests with an output line matching this regexp "+
+		"in full (empty to disable)")
+
+// A selector decides which events are considered, based on the names of
+// their package and test. A zero selector selects all events.
+type selector struct {
+	includePkg, excludePkg *regexp.Regexp
+	// includeTest and excludeTest hold a pattern for each level of subtests.
+	includeTest, excludeTest []*regexp.Regexp
+}
+
+// sel is the selector used by scanEvents.
+var sel selector
+
+// grepRE is the compiled -grep regexp, if any.
+var grepRE *regexp.Regexp
+
+func compilePkg(flagName, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("-%s: %w", flagName, err)
+	}
+	return re, nil
+}
+
+func compileTest(flagName, expr string) ([]*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	var res []*regexp.Regexp
+	for _, s := range splitRegexp(expr) {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %w", flagName, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// newSelector returns a selector from the given regexps, any of which may be
+// empty.
+func newSelector(includePkg, excludePkg, includeTest, excludeTest string) (selector, error) {
+	var s selector
+	var err error
+	if s.includePkg, err = compilePkg("include-pkg", includePkg); err != nil {
+		return selector{}, err
+	}
+	if s.excludePkg, err = compilePkg("exclude-pkg", excludePkg); err != nil {
+		return selector{}, err
+	}
+	if s.includeTest, err = compileTest("include-test", includeTest); err != nil {
+		return selector{}, err
+	}
+	if s.excludeTest, err = compileTest("exclude-test", excludeTest); err != nil {
+		return selector{}, err
+	}
+	return s, nil
+}
+
+// splitRegexp splits a regexp at the slashes that aren't inside of brackets or
+// parentheses, like go test does for -run and -skip.
+func splitRegexp(s string) []string {
+	var res []string
+	var cs, ps int // bracket and parenthesis depth
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			cs++
+		case ']':
+			if cs--; cs < 0 {
+				cs = 0
+			}
+		case '(':
+			if cs == 0 {
+				ps++
+			}
+		case ')':
+			if cs == 0 {
+				if ps--; ps < 0 {
+					ps = 0
+				}
+			}
+		case '\\':
+			i++
+		case '/':
+			if cs == 0 && ps == 0 {
+				res = append(res, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, s[start:])
+}
+
+// matchLevels returns whether each level of the test name matches the
+// corresponding pattern. If the name has fewer levels than there are
+// patterns, it returns partial.
+func matchLevels(patterns []*regexp.Regexp, test string, partial bool) bool {
+	elems := strings.Split(test, "/")
+	for i, re := range patterns {
+		if i >= len(elems) {
+			return partial
+		}
+		if !re.MatchString(elems[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns whether the event is selected. Package-level events are
+// selected based on the package name only. As with go test -run, the
+// ancestors of a selected subtest are selected too, so that the structure of
+// the tests is preserved.
+func (s selector) match(ev *testEvent) bool {
+	if s.includePkg != nil && !s.includePkg.MatchString(ev.Package) {
+		return false
+	}
+	if s.excludePkg != nil && s.excludePkg.MatchString(ev.Package) {
+		return false
+	}
+	if ev.Test == "" {
+		return true
+	}
+	if s.includeTest != nil && !matchLevels(s.includeTest, ev.Test, true /* partial */) {
+		return false
+	}
+	if s.excludeTest != nil && matchLevels(s.excludeTest, ev.Test, false /* partial */) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSplitRegexp(t *testing.T) {
+	for in, exp := range map[string]string{
+		"":            "",
+		"TestA":       "TestA",
+		"TestA/b":     "TestA|b",
+		"Test(A/B)/c": "Test(A/B)|c",
+		"Test[/]/c":   "Test[/]|c",
+		`Test\/x/c`:   `Test\/x|c`,
+	} {
+		if s := strings.Join(splitRegexp(in), "|"); s != exp {
+			t.Errorf("%q: expected %q, got %q", in, exp, s)
+		}
+	}
+}
+
+func TestSelector(t *testing.T) {
+	s, err := newSelector("^example.com/", "/internal/", "TestA/b", "TestA/b/skipped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		pkg, test string
+		exp       bool
+	}{
+		{"example.com/p", "", true},
+		{"other.com/p", "", false},
+		{"example.com/internal/p", "", false},
+		{"other.com/p", "TestA", false},
+		// Ancestors of selected subtests are selected.
+		{"example.com/p", "TestA", true},
+		{"example.com/p", "TestA/b", true},
+		{"example.com/p", "TestA/b/c", true},
+		{"example.com/p", "TestA/c", false},
+		{"example.com/p", "TestB", false},
+		{"example.com/p", "TestA/b/skipped", false},
+		{"example.com/p", "TestA/b/skipped/deeper", false},
+	} {
+		if act := s.match(&testEvent{Package: tc.pkg, Test: tc.test}); act != tc.exp {
+			t.Errorf("%s %s: expected %t, got %t", tc.pkg, tc.test, tc.exp, act)
+		}
+	}
+
+	if _, err := newSelector("", "", "Test(", ""); err == nil || !strings.HasPrefix(err.Error(), "-include-test: ") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFilterSelect(t *testing.T) {
+	defer func(prev selector) { sel = prev }(sel)
+	var err error
+	if sel, err = newSelector("", "", "", "TestB"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runFilter(t, "omit", events(t,
+		"run TestA",
+		"fail TestA",
+		"run TestB",
+		"fail TestB",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireEqual(t, []string{"run TestA", "fail TestA"}, out)
+}
+
+func TestFilterGrep(t *testing.T) {
+	defer func(prev *regexp.Regexp) { grepRE = prev }(grepRE)
+	grepRE = regexp.MustCompile("WARNING: DATA RACE")
+	in := events(t,
+		"run TestA",
+		"output TestA fine",
+		"pass TestA",
+		"run TestB",
+		"run TestB/racy",
+		"output TestB/racy ==================",
+		"output TestB/racy WARNING: DATA RACE",
+		"pass TestB/racy",
+		"pass TestB",
+	)
+	for _, m := range []string{"strip", "omit"} {
+		t.Run(m, func(t *testing.T) {
+			out, err := runFilter(t, m, in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var exp []string
+			if m == "strip" {
+				exp = append(exp, "run TestA", "pass TestA")
+			}
+			exp = append(exp,
+				"run TestB",
+				"run TestB/racy",
+				"output TestB/racy ==================",
+				"output TestB/racy WARNING: DATA RACE",
+				"pass TestB/racy",
+				"pass TestB",
+			)
+			requireEqual(t, exp, out)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type pkgCounts struct {
+	pass, fail, skip int
+}
+
+type testResult struct {
+	tup
+	elapsed float64
+}
+
+// A summary accumulates the outcome of all tests seen in a stream. A nil
+// *summary ignores all events, so that it can be passed around
+// unconditionally.
+type summary struct {
+	pkgs    []string // in order of appearance
+	counts  map[string]*pkgCounts
+	running map[tup]int // to order of appearance
+	seq     int
+	done    []testResult
+	failed  []tup
+}
+
+func newSummary() *summary {
+	return &summary{
+		counts:  map[string]*pkgCounts{},
+		running: map[tup]int{},
+	}
+}
+
+func (s *summary) observe(ev *testEvent) {
+	if s == nil || ev.Package == "" {
+		return
+	}
+	c := s.counts[ev.Package]
+	if c == nil {
+		c = &pkgCounts{}
+		s.counts[ev.Package] = c
+		s.pkgs = append(s.pkgs, ev.Package)
+	}
+	if ev.Test == "" {
+		return
+	}
+	key := tup{ev.Package, ev.Test}
+	if _, ok := s.running[key]; !ok && ev.Action == "run" {
+		s.seq++
+		s.running[key] = s.seq
+	}
+	switch ev.Action {
+	case "pass":
+		c.pass++
+	case "fail":
+		c.fail++
+		s.failed = append(s.failed, key)
+	case "skip":
+		c.skip++
+	default:
+		return
+	}
+	delete(s.running, key)
+	s.done = append(s.done, testResult{tup: key, elapsed: ev.Elapsed})
+}
+
+// write prints the summary, listing at most slowest of the slowest tests.
+func (s *summary) write(w io.Writer, slowest int) error {
+	ew := &errWriter{w: w}
+	fmt.Fprintln(ew, "=== SUMMARY")
+	for _, pkg := range s.pkgs {
+		c := s.counts[pkg]
+		fmt.Fprintf(ew, "%s: %d passed, %d failed, %d skipped\n", pkg, c.pass, c.fail, c.skip)
+	}
+
+	done := append([]testResult(nil), s.done...)
+	sort.SliceStable(done, func(i, j int) bool {
+		return done[i].elapsed > done[j].elapsed
+	})
+	if len(done) > slowest {
+		done = done[:slowest]
+	}
+	if len(done) > 0 {
+		fmt.Fprintln(ew, "\nSlowest tests:")
+		for _, r := range done {
+			fmt.Fprintf(ew, "  %8.2fs %s %s\n", r.elapsed, r.pkg, r.test)
+		}
+	}
+
+	if len(s.failed) > 0 {
+		fmt.Fprintln(ew, "\nFailed tests:")
+		for _, key := range s.failed {
+			fmt.Fprintf(ew, "  %s %s\n", key.pkg, key.test)
+		}
+	}
+
+	if len(s.running) > 0 {
+		unterminated := make([]tup, 0, len(s.running))
+		for key := range s.running {
+			unterminated = append(unterminated, key)
+		}
+		sort.Slice(unterminated, func(i, j int) bool {
+			return s.running[unterminated[i]] < s.running[unterminated[j]]
+		})
+		fmt.Fprintln(ew, "\nUnterminated tests:")
+		for _, key := range unterminated {
+			fmt.Fprintf(ew, "  %s %s\n", key.pkg, key.test)
+		}
+	}
+	return ew.err
+}
+
+// errWriter remembers the first error returned by w and discards all writes
+// after it.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	var n int
+	n, ew.err = ew.w.Write(p)
+	return n, ew.err
+}
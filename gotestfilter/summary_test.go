@@ -0,0 +1,65 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSummary(t *testing.T) {
+	var files []io.Reader
+	for _, name := range []string{"testdata/basic.json", "testdata/unterminated.json"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	sum := newSummary()
+	if err := junit(io.MultiReader(files...), io.Discard, sum); err == nil {
+		t.Fatal("expected an error")
+	}
+	var buf strings.Builder
+	if err := sum.write(&buf, 2); err != nil {
+		t.Fatal(err)
+	}
+	const exp = `=== SUMMARY
+example.com/sample/a: 2 passed, 3 failed, 1 skipped
+example.com/sample/b: 1 passed, 1 failed, 0 skipped
+example.com/c: 1 passed, 0 failed, 0 skipped
+
+Slowest tests:
+      1.50s example.com/c TestOK
+      0.00s example.com/sample/a TestPass
+
+Failed tests:
+  example.com/sample/a TestFail
+  example.com/sample/a TestSub/bad
+  example.com/sample/a TestSub
+  example.com/sample/b TestPanic
+
+Unterminated tests:
+  example.com/c TestHang
+`
+	if s := buf.String(); s != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, s)
+	}
+}
+
+func TestSummaryNil(t *testing.T) {
+	var sum *summary
+	sum.observe(&testEvent{Action: "fail", Package: "p", Test: "TestFoo"})
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A node is a test or subtest in a tree.
+type node struct {
+	id      int   // index in tree.byID
+	parent  *node // nil for the top-level test
+	started bool
+	done    bool
+	failed  bool
+}
+
+// A tree buffers the events of a top-level test and all of its subtests.
+// Subtests are reported along with their top-level test once it terminates,
+// so that the output of a failing subtest is accompanied by that of its
+// ancestors (which often contains the relevant setup), with lines in their
+// original order.
+type tree struct {
+	seq   int    // order of creation
+	pkg   string // of the tests
+	name  string // of the top-level test
+	root  *node
+	nodes map[string]*node // by test name
+	byID  []*node
+	// time is the time of the latest event.
+	time time.Time
+	// matched is set if a line of output matched grepRE.
+	matched bool
+	// lines holds the events, each encoded as a record
+	//
+	//   <node id> <edge><line>\n
+	//
+	// where edge is 'e' for the first event of a test and for the event
+	// terminating it, and '-' otherwise. Edges are kept for tests whose
+	// output is stripped, to preserve the timing information.
+	lines *capBuffer
+}
+
+// rootName returns the name of the top-level test of the given (sub)test.
+func rootName(test string) string {
+	if i := strings.IndexByte(test, '/'); i >= 0 {
+		return test[:i]
+	}
+	return test
+}
+
+func newTree(seq int, pkg, root string) *tree {
+	t := &tree{seq: seq, pkg: pkg, name: root, nodes: map[string]*node{}, lines: newCapBuffer()}
+	t.root = t.newNode(root, nil)
+	return t
+}
+
+func (t *tree) newNode(test string, parent *node) *node {
+	n := &node{id: len(t.byID), parent: parent}
+	t.nodes[test] = n
+	t.byID = append(t.byID, n)
+	return n
+}
+
+// add buffers an event of the given test, which must be the root of the tree
+// or one of its subtests.
+func (t *tree) add(test string, line string, ev *testEvent) error {
+	n, ok := t.nodes[test]
+	if !ok {
+		// Subtest names may themselves contain slashes, so the parent is
+		// the closest known ancestor.
+		parent := t.root
+		for p := test; ; {
+			i := strings.LastIndexByte(p, '/')
+			if i < 0 {
+				break
+			}
+			p = p[:i]
+			if pn, ok := t.nodes[p]; ok {
+				parent = pn
+				break
+			}
+		}
+		n = t.newNode(test, parent)
+	}
+	t.time = ev.Time
+	if ev.Action == "output" && grepRE != nil && grepRE.MatchString(ev.Output) {
+		t.matched = true
+	}
+	edge := !n.started
+	n.started = true
+	switch ev.Action {
+	case "pass", "skip", "fail":
+		n.done = true
+		n.failed = ev.Action == "fail"
+		edge = true
+	}
+	flag := '-'
+	if edge {
+		flag = 'e'
+	}
+	return t.lines.add(fmt.Sprintf("%d %c%s\n", n.id, flag, line))
+}
+
+// unterminated returns the number of tests in the tree that have not
+// terminated.
+func (t *tree) unterminated() int {
+	var n int
+	for _, nd := range t.nodes {
+		if !nd.done {
+			n++
+		}
+	}
+	return n
+}
+
+// write prints the buffered events, and releases them. The events of failed
+// tests are printed in full. If strip is set, passing and skipped tests whose
+// parent is printed in full are collapsed into their first and terminating
+// events, and their subtests are omitted; otherwise, they're omitted
+// entirely. If all is set, all events are printed. If some events were
+// elided to bound the size of the buffer, an output event of the top-level
+// test takes their place.
+func (t *tree) write(out io.Writer, strip, all bool) error {
+	defer t.lines.release()
+	w := &lineWriter{fn: func(rec []byte) error {
+		var id int
+		var flag byte
+		var line []byte
+		if i := bytes.IndexByte(rec, ' '); i > 0 && i+1 < len(rec) {
+			id, _ = strconv.Atoi(string(rec[:i]))
+			flag, line = rec[i+1], rec[i+2:]
+		}
+		if id >= len(t.byID) {
+			return fmt.Errorf("corrupt record: %q", rec)
+		}
+		n := t.byID[id]
+		show := all || n.failed ||
+			(strip && flag == 'e' && (n.parent == nil || n.parent.failed))
+		if !show {
+			return nil
+		}
+		_, err := fmt.Fprintf(out, "%s\n", line)
+		return err
+	}}
+	return t.lines.writeTo(w, func(elided int64) string {
+		b, err := json.Marshal(testEvent{
+			Time: t.time, Action: "output", Package: t.pkg, Test: t.name, Output: elisionNote(elided),
+		})
+		if err != nil {
+			panic(err)
+		}
+		return fmt.Sprintf("%d -%s\n", t.root.id, b)
+	})
+}
+
+// A lineWriter calls fn for each complete line written to it, without the EOL
+// marker.
+type lineWriter struct {
+	buf []byte
+	fn  func(line []byte) error
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			lw.buf = append(lw.buf, p...)
+			return n, nil
+		}
+		line := p[:i]
+		if len(lw.buf) > 0 {
+			lw.buf = append(lw.buf, line...)
+			line = lw.buf
+		}
+		if err := lw.fn(line); err != nil {
+			return 0, err
+		}
+		lw.buf = lw.buf[:0]
+		p = p[i+1:]
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
 
 	"github.com/tbg/goplay/proxy"
 )
@@ -14,11 +19,25 @@ import (
 var options struct {
 	listenAddress string
 	targetAddress string
+	directory     string
+	handshake     time.Duration
+	wakeBudget    time.Duration
 	cert          string
 	key           string
 	verify        bool
 }
 
+// tenantFromParams extracts the tenant from a database name of the form
+// <db>_<tenantID>, rewriting the database name to <db>.
+func tenantFromParams(p map[string]string) (string, error) {
+	sl := strings.SplitN(p["database"], "_", 2)
+	if len(sl) != 2 {
+		return "", errors.Newf("malformed database name")
+	}
+	p["database"] = sl[0]
+	return sl[1], nil
+}
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Println(err)
@@ -40,6 +59,12 @@ func run() error {
 		"file containing PEM-encoded x509 key for listen address")
 	flag.StringVar(&options.targetAddress, "target", "127.0.0.1:26257",
 		"Address to proxy to (a Postgres-compatible server)")
+	flag.StringVar(&options.directory, "directory", "",
+		"JSON file mapping tenant IDs to addresses; if set, -target is ignored")
+	flag.DurationVar(&options.handshake, "handshake-timeout", 10*time.Second,
+		"How long a client may take to connect to its backend, not counting -wake-budget (0 for no limit)")
+	flag.DurationVar(&options.wakeBudget, "wake-budget", 0,
+		"How long to hold clients while their backend is starting or unreachable, in addition to -handshake-timeout")
 	flag.BoolVar(&options.verify, "verify", true,
 		"If true, use InsecureSkipVerify=true for connections to target")
 	flag.Parse()
@@ -59,7 +84,30 @@ func run() error {
 	opts := proxy.Options{
 		IncomingTLSConfig: &tls.Config{Certificates: []tls.Certificate{cer}},
 		OutgoingTLSConfig: &tls.Config{InsecureSkipVerify: !options.verify},
-		OutgoingAddr:      options.targetAddress,
+		OutgoingAddrFromParams: func(context.Context, map[string]string) (string, error) {
+			return options.targetAddress, nil
+		},
+		WakeBudget: options.wakeBudget,
+	}
+	if options.handshake > 0 {
+		// The time clients are held while their backend wakes up counts
+		// against the handshake timeout, which would otherwise cap it.
+		opts.HandshakeTimeout = options.handshake + options.wakeBudget
+	}
+	if options.directory != "" {
+		ctx := context.Background()
+		dir, err := proxy.NewFileDirectory(options.directory)
+		if err != nil {
+			return err
+		}
+		go dir.Run(ctx, 5*time.Second)
+		opts.OutgoingAddrFromParams = proxy.AddrFromDirectory(
+			proxy.NewCachingDirectory(ctx, dir, proxy.CacheOptions{
+				TTL:         time.Minute,
+				NegativeTTL: 5 * time.Second,
+			}),
+			tenantFromParams,
+		)
 	}
 
 	return proxy.Serve(ln, opts)
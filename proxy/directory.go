@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ErrTenantNotFound is returned (possibly wrapped) from Directory.Lookup when
+// the directory does not know about the requested tenant.
+var ErrTenantNotFound = errors.New("tenant not found")
+
+// ErrTenantStarting is returned (possibly wrapped) from Directory.Lookup when
+// the tenant exists but has no running backend yet, for example because it
+// was scaled to zero and is being woken up. Proxy holds on to the client
+// until the backend appears or Options.WakeBudget is exhausted.
+var ErrTenantStarting = errors.New("tenant starting")
+
+// A Directory resolves tenants to the addresses of the SQL servers serving
+// them.
+type Directory interface {
+	// Lookup returns the endpoints (host:port) for the given tenant. If the
+	// tenant is unknown, an error for which errors.Is(err, ErrTenantNotFound)
+	// holds is returned; if it is starting, ErrTenantStarting.
+	Lookup(ctx context.Context, tenantID string) ([]string, error)
+	// Watch returns a channel on which the IDs of tenants whose endpoints
+	// have changed are delivered. The channel is closed when ctx is done.
+	// A slow consumer may miss notifications, in which case it receives
+	// AllTenants instead.
+	Watch(ctx context.Context) <-chan string
+}
+
+// AllTenants is delivered on the channel returned by Directory.Watch in place
+// of notifications that were lost, meaning that the endpoints of any tenant
+// may have changed.
+const AllTenants = ""
+
+// AddrFromDirectory returns a function suitable for use as
+// Options.OutgoingAddrFromParams. It extracts the tenant from the startup
+// parameters via tenantFromParams and resolves it using the directory.
+func AddrFromDirectory(
+	dir Directory, tenantFromParams func(map[string]string) (tenantID string, clientErr error),
+) func(context.Context, map[string]string) (string, error) {
+	return func(ctx context.Context, p map[string]string) (string, error) {
+		tenantID, clientErr := tenantFromParams(p)
+		if clientErr != nil {
+			return "", clientErr
+		}
+		endpoints, err := dir.Lookup(ctx, tenantID)
+		if errors.Is(err, ErrTenantNotFound) {
+			return "", errors.Newf("unknown tenant %s", tenantID)
+		}
+		if errors.Is(err, ErrTenantStarting) {
+			return "", errors.Mark(errors.Newf("tenant %s is starting", tenantID), ErrTenantStarting)
+		}
+		if err != nil {
+			// Don't leak the internal error to the client, but keep it around
+			// for logging.
+			return "", errors.WithSecondaryError(errors.New("unable to look up tenant"), err)
+		}
+		if len(endpoints) == 0 {
+			return "", errors.Newf("no endpoints for tenant %s", tenantID)
+		}
+		return endpoints[rand.Intn(len(endpoints))], nil
+	}
+}
+
+// CacheOptions configure a CachingDirectory.
+type CacheOptions struct {
+	// TTL is how long a successful lookup is served from the cache.
+	TTL time.Duration
+	// NegativeTTL is how long a lookup that returned ErrTenantNotFound is
+	// served from the cache. Other errors, including ErrTenantStarting, are
+	// never cached.
+	NegativeTTL time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+type cacheEntry struct {
+	endpoints []string
+	err       error // only ever ErrTenantNotFound
+	expires   time.Time
+}
+
+// CachingDirectory is a Directory that caches the results of another
+// Directory. Entries are evicted when they expire or when the wrapped
+// Directory reports a change for the tenant (or for AllTenants, which evicts
+// all entries).
+type CachingDirectory struct {
+	dir  Directory
+	opts CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// gen is bumped by Invalidate, so that the results of lookups that were
+	// in flight meanwhile aren't cached, as they may be stale.
+	gen uint64
+}
+
+var _ Directory = (*CachingDirectory)(nil)
+
+// NewCachingDirectory wraps the given Directory in a cache. The cache watches
+// the wrapped Directory for changes until ctx is done.
+func NewCachingDirectory(ctx context.Context, dir Directory, opts CacheOptions) *CachingDirectory {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	d := &CachingDirectory{
+		dir:     dir,
+		opts:    opts,
+		entries: map[string]cacheEntry{},
+	}
+	ch := dir.Watch(ctx)
+	go func() {
+		for tenantID := range ch {
+			d.Invalidate(tenantID)
+		}
+	}()
+	return d
+}
+
+// Lookup implements Directory.
+func (d *CachingDirectory) Lookup(ctx context.Context, tenantID string) ([]string, error) {
+	now := d.opts.Now()
+	d.mu.Lock()
+	e, ok := d.entries[tenantID]
+	gen := d.gen
+	d.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		if e.err != nil {
+			return nil, e.err
+		}
+		return e.endpoints, nil
+	}
+
+	endpoints, err := d.dir.Lookup(ctx, tenantID)
+	var ttl time.Duration
+	switch {
+	case err == nil:
+		ttl = d.opts.TTL
+	case errors.Is(err, ErrTenantNotFound):
+		ttl = d.opts.NegativeTTL
+	default:
+		return nil, err
+	}
+	if ttl > 0 {
+		d.mu.Lock()
+		if d.gen == gen {
+			d.entries[tenantID] = cacheEntry{endpoints: endpoints, err: err, expires: now.Add(ttl)}
+		}
+		d.mu.Unlock()
+	}
+	return endpoints, err
+}
+
+// Watch implements Directory.
+func (d *CachingDirectory) Watch(ctx context.Context) <-chan string {
+	return d.dir.Watch(ctx)
+}
+
+// Invalidate evicts the cache entry for the given tenant, if any, or all
+// entries for AllTenants. The results of lookups in flight aren't cached.
+func (d *CachingDirectory) Invalidate(tenantID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	if tenantID == AllTenants {
+		d.entries = map[string]cacheEntry{}
+		return
+	}
+	delete(d.entries, tenantID)
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// FileDirectory is a Directory backed by a JSON file mapping tenant IDs to
+// their endpoints, for example:
+//
+//	{"29": ["127.0.0.1:26257", "127.0.0.1:26258"], "30": []}
+//
+// A tenant with no endpoints is considered to be starting (see
+// ErrTenantStarting).
+//
+// The file is read on creation and whenever Reload is called; Run reloads it
+// periodically when it changes on disk.
+type FileDirectory struct {
+	path string
+	mem  *MemDirectory
+
+	mu      sync.Mutex
+	modTime time.Time
+	loaded  map[string][]string
+}
+
+var _ Directory = (*FileDirectory)(nil)
+
+// NewFileDirectory returns a FileDirectory for the file at the given path,
+// which must exist and be valid.
+func NewFileDirectory(path string) (*FileDirectory, error) {
+	d := &FileDirectory{
+		path: path,
+		mem:  NewMemDirectory(),
+	}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload re-reads the file, notifying watchers of all tenants whose endpoints
+// changed. On error, the previous contents remain in effect.
+func (d *FileDirectory) Reload() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fi, err := os.Stat(d.path)
+	if err != nil {
+		return errors.Wrap(err, "reading tenant directory")
+	}
+	b, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return errors.Wrap(err, "reading tenant directory")
+	}
+	var tenants map[string][]string
+	if err := json.Unmarshal(b, &tenants); err != nil {
+		return errors.Wrapf(err, "parsing tenant directory %s", d.path)
+	}
+
+	for tenantID := range d.loaded {
+		if _, ok := tenants[tenantID]; !ok {
+			d.mem.Set(tenantID)
+		}
+	}
+	for tenantID, endpoints := range tenants {
+		if prev, ok := d.loaded[tenantID]; ok && reflect.DeepEqual(prev, endpoints) {
+			continue
+		}
+		if len(endpoints) == 0 {
+			d.mem.SetStarting(tenantID)
+		} else {
+			d.mem.Set(tenantID, endpoints...)
+		}
+	}
+	d.loaded = tenants
+	d.modTime = fi.ModTime()
+	return nil
+}
+
+// Run reloads the file whenever its modification time changes, checking at
+// the given interval, until ctx is done. Errors are logged.
+func (d *FileDirectory) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		fi, err := os.Stat(d.path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		d.mu.Lock()
+		changed := !fi.ModTime().Equal(d.modTime)
+		d.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := d.Reload(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Lookup implements Directory.
+func (d *FileDirectory) Lookup(ctx context.Context, tenantID string) ([]string, error) {
+	return d.mem.Lookup(ctx, tenantID)
+}
+
+// Watch implements Directory.
+func (d *FileDirectory) Watch(ctx context.Context) <-chan string {
+	return d.mem.Watch(ctx)
+}
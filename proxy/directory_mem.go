@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+)
+
+// MemDirectory is an in-memory Directory. It is safe for concurrent use.
+type MemDirectory struct {
+	mu       sync.Mutex
+	tenants  map[string][]string
+	starting map[string]struct{}
+	watchers map[chan string]struct{}
+}
+
+var _ Directory = (*MemDirectory)(nil)
+
+// NewMemDirectory returns an empty MemDirectory.
+func NewMemDirectory() *MemDirectory {
+	return &MemDirectory{
+		tenants:  map[string][]string{},
+		starting: map[string]struct{}{},
+		watchers: map[chan string]struct{}{},
+	}
+}
+
+// Set replaces the endpoints of the given tenant. Passing no endpoints
+// removes the tenant.
+func (d *MemDirectory) Set(tenantID string, endpoints ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.starting, tenantID)
+	if len(endpoints) == 0 {
+		delete(d.tenants, tenantID)
+	} else {
+		d.tenants[tenantID] = append([]string(nil), endpoints...)
+	}
+	d.notifyLocked(tenantID)
+}
+
+// SetStarting marks the given tenant as starting: until the next call to Set,
+// lookups return ErrTenantStarting.
+func (d *MemDirectory) SetStarting(tenantID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.tenants, tenantID)
+	d.starting[tenantID] = struct{}{}
+	d.notifyLocked(tenantID)
+}
+
+// Lookup implements Directory.
+func (d *MemDirectory) Lookup(ctx context.Context, tenantID string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.starting[tenantID]; ok {
+		return nil, errors.Wrapf(ErrTenantStarting, "tenant %s", tenantID)
+	}
+	endpoints, ok := d.tenants[tenantID]
+	if !ok {
+		return nil, errors.Wrapf(ErrTenantNotFound, "tenant %s", tenantID)
+	}
+	return append([]string(nil), endpoints...), nil
+}
+
+// Watch implements Directory.
+func (d *MemDirectory) Watch(ctx context.Context) <-chan string {
+	ch := make(chan string, watchBuffer)
+	d.mu.Lock()
+	d.watchers[ch] = struct{}{}
+	d.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.watchers, ch)
+		close(ch)
+	}()
+	return ch
+}
+
+// watchBuffer is the capacity of the channels returned by Watch.
+const watchBuffer = 16
+
+func (d *MemDirectory) notifyLocked(tenantID string) {
+	for ch := range d.watchers {
+		select {
+		case ch <- tenantID:
+			continue
+		default:
+		}
+		// The watcher fell behind. Replace its pending notifications with
+		// AllTenants. There is room for it once drained, since we're the
+		// only sender.
+	drain:
+		for {
+			select {
+			case <-ch:
+			default:
+				break drain
+			}
+		}
+		ch <- AllTenants
+	}
+}
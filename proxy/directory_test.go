@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/require"
+)
+
+type countingDirectory struct {
+	Directory
+	n int32
+}
+
+func (d *countingDirectory) Lookup(ctx context.Context, tenantID string) ([]string, error) {
+	atomic.AddInt32(&d.n, 1)
+	return d.Directory.Lookup(ctx, tenantID)
+}
+
+func (d *countingDirectory) count() int {
+	return int(atomic.LoadInt32(&d.n))
+}
+
+func testingTenantFromDatabase(p map[string]string) (string, error) {
+	sl := strings.SplitN(p["database"], "_", 2)
+	if len(sl) != 2 {
+		return "", errors.Newf("malformed database name")
+	}
+	p["database"] = sl[0]
+	return sl[1], nil
+}
+
+func TestMemDirectory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := NewMemDirectory()
+	ch := d.Watch(ctx)
+
+	_, err := d.Lookup(ctx, "29")
+	require.True(t, errors.Is(err, ErrTenantNotFound), "%+v", err)
+
+	d.Set("29", "a:1", "b:2")
+	require.Equal(t, "29", <-ch)
+	endpoints, err := d.Lookup(ctx, "29")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1", "b:2"}, endpoints)
+
+	d.Set("29")
+	require.Equal(t, "29", <-ch)
+	_, err = d.Lookup(ctx, "29")
+	require.True(t, errors.Is(err, ErrTenantNotFound), "%+v", err)
+
+	cancel()
+	for range ch {
+	}
+	_, err = d.Lookup(ctx, "29")
+	require.True(t, errors.Is(err, context.Canceled), "%+v", err)
+}
+
+func TestCachingDirectory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Unix(0, 0)
+	mem := NewMemDirectory()
+	mem.Set("29", "a:1")
+	counting := &countingDirectory{Directory: mem}
+	d := NewCachingDirectory(ctx, counting, CacheOptions{
+		TTL:         time.Minute,
+		NegativeTTL: time.Second,
+		Now:         func() time.Time { return now },
+	})
+
+	for i := 0; i < 3; i++ {
+		endpoints, err := d.Lookup(ctx, "29")
+		require.NoError(t, err)
+		require.Equal(t, []string{"a:1"}, endpoints)
+	}
+	require.Equal(t, 1, counting.count())
+
+	// Negative caching.
+	for i := 0; i < 3; i++ {
+		_, err := d.Lookup(ctx, "30")
+		require.True(t, errors.Is(err, ErrTenantNotFound), "%+v", err)
+	}
+	require.Equal(t, 2, counting.count())
+
+	// The negative entry expires long before the positive one.
+	now = now.Add(2 * time.Second)
+	_, err := d.Lookup(ctx, "30")
+	require.True(t, errors.Is(err, ErrTenantNotFound), "%+v", err)
+	_, err = d.Lookup(ctx, "29")
+	require.NoError(t, err)
+	require.Equal(t, 3, counting.count())
+
+	// A change in the underlying directory invalidates the entry.
+	mem.Set("29", "b:2")
+	require.Eventually(t, func() bool {
+		endpoints, err := d.Lookup(ctx, "29")
+		require.NoError(t, err)
+		return endpoints[0] == "b:2"
+	}, 5*time.Second, time.Millisecond)
+
+	// Other errors are not cached.
+	canceled, cancelLookup := context.WithCancel(ctx)
+	cancelLookup()
+	n := counting.count()
+	for i := 0; i < 2; i++ {
+		_, err := d.Lookup(canceled, "31")
+		require.True(t, errors.Is(err, context.Canceled), "%+v", err)
+	}
+	require.Equal(t, n+2, counting.count())
+}
+
+func TestFileDirectory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "directory")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "tenants.json")
+
+	write := func(s string) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(s), 0644))
+	}
+
+	write(`{"29": ["a:1"], "30": ["b:2"]}`)
+	d, err := NewFileDirectory(path)
+	require.NoError(t, err)
+	ch := d.Watch(ctx)
+
+	endpoints, err := d.Lookup(ctx, "29")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a:1"}, endpoints)
+
+	write(`{"29": ["a:1"], "31": ["c:3"]}`)
+	require.NoError(t, d.Reload())
+	var changed []string
+	for len(changed) < 2 {
+		changed = append(changed, <-ch)
+	}
+	require.ElementsMatch(t, []string{"30", "31"}, changed)
+	_, err = d.Lookup(ctx, "30")
+	require.True(t, errors.Is(err, ErrTenantNotFound), "%+v", err)
+
+	// A broken file leaves the previous state in place.
+	write(`{`)
+	require.Error(t, d.Reload())
+	endpoints, err = d.Lookup(ctx, "31")
+	require.NoError(t, err)
+	require.Equal(t, []string{"c:3"}, endpoints)
+}
+
+func TestProxyDirectory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mem := NewMemDirectory()
+	mem.Set("29", "undialable%$!@$")
+	opts := Options{
+		OutgoingAddrFromParams: AddrFromDirectory(
+			NewCachingDirectory(ctx, mem, CacheOptions{TTL: time.Minute, NegativeTTL: time.Minute}),
+			testingTenantFromDatabase,
+		),
+	}
+	addr, done := setupTestProxyWithCerts(t, &opts)
+	defer done()
+
+	u := fmt.Sprintf("postgres://unused:unused@%s/", addr)
+	assertConnectErr(t, u, "defaultdb_29?sslmode=require", "unable to reach backend SQL server")
+	assertConnectErr(t, u, "defaultdb_30?sslmode=require", "unknown tenant 30")
+	assertConnectErr(t, u, "defaultdb?sslmode=require", "malformed database name")
+}
+
+func TestProxyHandshakeTimeout(t *testing.T) {
+	lookupErr := make(chan error, 1)
+	opts := Options{
+		// A lookup that hangs until the handshake timeout fires.
+		OutgoingAddrFromParams: func(ctx context.Context, _ map[string]string) (string, error) {
+			<-ctx.Done()
+			lookupErr <- ctx.Err()
+			return "", ctx.Err()
+		},
+		HandshakeTimeout: time.Second,
+	}
+	addr, done := setupTestProxyWithCerts(t, &opts)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := pgx.Connect(ctx, fmt.Sprintf("postgres://unused:unused@%s/defaultdb_29?sslmode=require", addr))
+	if err == nil {
+		_ = conn.Close(ctx)
+	}
+	require.Error(t, err)
+	select {
+	case err := <-lookupErr:
+		require.True(t, errors.Is(err, context.DeadlineExceeded), "%+v", err)
+	case <-ctx.Done():
+		t.Fatal("lookup was not canceled")
+	}
+}
+
+// watchDirectory is a Directory whose Watch channel is controlled by the test.
+type watchDirectory struct {
+	*MemDirectory
+	ch chan string
+}
+
+func (d *watchDirectory) Watch(context.Context) <-chan string {
+	return d.ch
+}
+
+func TestMemDirectoryWatchOverflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := NewMemDirectory()
+	ch := d.Watch(ctx)
+	// Changes beyond the buffer of the watcher are collapsed into
+	// AllTenants, rather than dropped.
+	for i := 0; i < watchBuffer+3; i++ {
+		d.Set(fmt.Sprint(i), "a:1")
+	}
+	var got []string
+	for len(got) < 3 {
+		got = append(got, <-ch)
+	}
+	require.Equal(t, []string{AllTenants, fmt.Sprint(watchBuffer + 1), fmt.Sprint(watchBuffer + 2)}, got)
+}
+
+func TestCachingDirectoryAllTenants(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mem := NewMemDirectory()
+	wd := &watchDirectory{MemDirectory: mem, ch: make(chan string)}
+	d := NewCachingDirectory(ctx, wd, CacheOptions{TTL: time.Minute})
+	for _, id := range []string{"29", "30"} {
+		mem.Set(id, "a:1")
+		_, err := d.Lookup(ctx, id)
+		require.NoError(t, err)
+		mem.Set(id, "b:2")
+	}
+	wd.ch <- AllTenants
+	require.Eventually(t, func() bool {
+		for _, id := range []string{"29", "30"} {
+			endpoints, err := d.Lookup(ctx, id)
+			require.NoError(t, err)
+			if endpoints[0] != "b:2" {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+}
+
+// blockingDirectory is a Directory whose lookups block until released, after
+// looking up the endpoints.
+type blockingDirectory struct {
+	Directory
+	looked  chan struct{} // signaled by the first lookup
+	release chan struct{}
+}
+
+func (d *blockingDirectory) Lookup(ctx context.Context, tenantID string) ([]string, error) {
+	endpoints, err := d.Directory.Lookup(ctx, tenantID)
+	select {
+	case d.looked <- struct{}{}:
+	default:
+	}
+	<-d.release
+	return endpoints, err
+}
+
+func TestCachingDirectoryInvalidateInFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mem := NewMemDirectory()
+	mem.Set("29", "a:1")
+	bd := &blockingDirectory{
+		Directory: &watchDirectory{MemDirectory: mem, ch: make(chan string)},
+		looked:    make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	d := NewCachingDirectory(ctx, bd, CacheOptions{TTL: time.Minute})
+
+	res := make(chan []string, 1)
+	go func() {
+		endpoints, err := d.Lookup(ctx, "29")
+		if err != nil {
+			t.Error(err)
+		}
+		res <- endpoints
+	}()
+	<-bd.looked
+	// The tenant changes while the lookup is in flight, so its result is
+	// returned, but not cached.
+	mem.Set("29", "b:2")
+	d.Invalidate("29")
+	close(bd.release)
+	require.Equal(t, []string{"a:1"}, <-res)
+	endpoints, err := d.Lookup(ctx, "29")
+	require.NoError(t, err)
+	require.Equal(t, []string{"b:2"}, endpoints)
+}
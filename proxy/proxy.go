@@ -1,10 +1,12 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"io"
 	"net"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/jackc/pgproto3/v2"
@@ -16,8 +18,23 @@ type Options struct {
 
 	// TODO(tbg): this is unimplemented and exists only to check which clients
 	// allow use of SNI. Should always return ("", nil).
-	OutgoingAddrFromSNI    func(serverName string) (addr string, clientErr error)
-	OutgoingAddrFromParams func(map[string]string) (addr string, clientErr error)
+	OutgoingAddrFromSNI func(serverName string) (addr string, clientErr error)
+	// OutgoingAddrFromParams resolves the startup parameters sent by the
+	// client to the address of the backend. The context is canceled when
+	// the handshake timeout expires. See AddrFromDirectory.
+	OutgoingAddrFromParams func(context.Context, map[string]string) (addr string, clientErr error)
+
+	// HandshakeTimeout, if nonzero, bounds the time from accepting the
+	// client connection to having relayed its StartupMessage to the backend.
+	HandshakeTimeout time.Duration
+
+	// WakeBudget, if nonzero, is how long a client is held while its backend
+	// is starting (as indicated by an OutgoingAddrFromParams error marked with
+	// ErrTenantStarting) or refuses connections. The backend is polled every
+	// WakePollInterval (defaulting to 100ms) until it can be dialed. The
+	// HandshakeTimeout, if any, still applies.
+	WakeBudget       time.Duration
+	WakePollInterval time.Duration
 
 	_ struct{} // force explicit init of this struct
 }
@@ -31,6 +48,17 @@ func sendErr(conn net.Conn, msg string) {
 }
 
 func Proxy(conn net.Conn, opts Options) error {
+	ctx := context.Background()
+	if opts.HandshakeTimeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, opts.HandshakeTimeout)
+		defer cancel()
+		deadline, _ := ctx.Deadline()
+		if err := conn.SetDeadline(deadline); err != nil {
+			return errors.Wrap(err, "setting handshake deadline")
+		}
+	}
+
 	{
 		m, err := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn).ReceiveStartupMessage()
 		if err != nil {
@@ -75,16 +103,14 @@ func Proxy(conn net.Conn, opts Options) error {
 		return errors.Newf("unsupported post-TLS startup message: %T", m)
 	}
 
-	outgoingAddr, clientErr := opts.OutgoingAddrFromParams(msg.Parameters)
-	if clientErr != nil {
-		sendErr(conn, clientErr.Error())
-		return errors.Wrap(clientErr, "rejected by OnClientInfo")
-	}
-
-	crdbConn, err := net.Dial("tcp", outgoingAddr)
+	crdbConn, err := dialBackend(ctx, conn, opts, msg)
 	if err != nil {
-		sendErr(conn, "unable to reach backend SQL server")
-		return errors.Wrap(err, "dialing target server")
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := crdbConn.SetDeadline(deadline); err != nil {
+			return errors.Wrap(err, "setting handshake deadline")
+		}
 	}
 
 	// Send SSLRequest.
@@ -107,6 +133,14 @@ func Proxy(conn net.Conn, opts Options) error {
 		return errors.Wrap(err, "relaying StartupMessage to target server")
 	}
 
+	// The handshake is done, lift its deadline.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return errors.Wrap(err, "clearing handshake deadline")
+	}
+	if err := crdbConn.SetDeadline(time.Time{}); err != nil {
+		return errors.Wrap(err, "clearing handshake deadline")
+	}
+
 	errOutgoing := make(chan error)
 	errIncoming := make(chan error)
 
@@ -133,3 +167,65 @@ func Proxy(conn net.Conn, opts Options) error {
 		return errors.Wrap(err, "copying from target server to client")
 	}
 }
+
+// dialBackend resolves the backend for the given StartupMessage and dials it,
+// waiting for the backend to come up if Options.WakeBudget allows. On success,
+// the message's parameters are replaced by those rewritten by
+// OutgoingAddrFromParams. On error, the client has been sent an error message.
+func dialBackend(
+	ctx context.Context, conn net.Conn, opts Options, msg *pgproto3.StartupMessage,
+) (net.Conn, error) {
+	interval := opts.WakePollInterval
+	if interval == 0 {
+		interval = 100 * time.Millisecond
+	}
+	wakeDeadline := time.Now().Add(opts.WakeBudget)
+
+	for {
+		// OutgoingAddrFromParams may rewrite the parameters, so hand it a copy
+		// in case we need to call it again.
+		params := make(map[string]string, len(msg.Parameters))
+		for k, v := range msg.Parameters {
+			params[k] = v
+		}
+		outgoingAddr, clientErr := opts.OutgoingAddrFromParams(ctx, params)
+		if clientErr != nil && !errors.Is(clientErr, ErrTenantStarting) {
+			sendErr(conn, clientErr.Error())
+			return nil, errors.Wrap(clientErr, "rejected by OnClientInfo")
+		}
+
+		var err error
+		if clientErr == nil {
+			var d net.Dialer
+			var crdbConn net.Conn
+			crdbConn, err = d.DialContext(ctx, "tcp", outgoingAddr)
+			if err == nil {
+				msg.Parameters = params
+				return crdbConn, nil
+			}
+		}
+
+		if opts.WakeBudget == 0 {
+			if clientErr != nil {
+				sendErr(conn, clientErr.Error())
+				return nil, errors.Wrap(clientErr, "rejected by OnClientInfo")
+			}
+			sendErr(conn, "unable to reach backend SQL server")
+			return nil, errors.Wrap(err, "dialing target server")
+		}
+		if err == nil {
+			err = clientErr
+		}
+
+		if time.Now().Add(interval).After(wakeDeadline) {
+			sendErr(conn, "timed out waiting for backend SQL server to start")
+			return nil, errors.Wrapf(err, "backend not available after %s", opts.WakeBudget)
+		}
+		select {
+		case <-ctx.Done():
+			sendErr(conn, "timed out waiting for backend SQL server to start")
+			return nil, errors.Wrap(err, "handshake timeout while waiting for backend")
+		case <-time.After(interval):
+		}
+	}
+}
@@ -7,9 +7,12 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/require"
 )
@@ -53,8 +56,10 @@ openssl req -new -x509 -sha256 -key testserver.key -out testserver.crt -days 365
 	return ln.Addr().String(), done
 }
 
-func testingTenantIDFromDatabaseForAddr(addr string, validTenant string) func(map[string]string) (string, error) {
-	return func(p map[string]string) (_ string, clientErr error) {
+func testingTenantIDFromDatabaseForAddr(
+	addr string, validTenant string,
+) func(context.Context, map[string]string) (string, error) {
+	return func(_ context.Context, p map[string]string) (_ string, clientErr error) {
 		const dbKey = "database"
 		db, ok := p[dbKey]
 		if !ok {
@@ -89,7 +94,7 @@ func assertConnectErr(t *testing.T, prefix, suffix, expErr string) {
 func TestLongDBName(t *testing.T) {
 	var m map[string]string
 	opts := Options{
-		OutgoingAddrFromParams: func(mm map[string]string) (string, error) {
+		OutgoingAddrFromParams: func(_ context.Context, mm map[string]string) (string, error) {
 			m = mm
 			return "", errors.New("boom")
 		},
@@ -159,3 +164,119 @@ func TestProxyAgainstSecureCRDB(t *testing.T) {
 	require.NoError(t, err)
 	require.EqualValues(t, 1, n)
 }
+
+// fakeBackendTLSConfig returns the TLS config of the server started by
+// startFakeBackend.
+func fakeBackendTLSConfig(t *testing.T) *tls.Config {
+	cer, err := tls.LoadX509KeyPair("testserver.crt", "testserver.key")
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{cer}}
+}
+
+// startFakeBackend starts a server that speaks just enough of the Postgres
+// protocol (behind TLS) to let a client connect. The parameters of each
+// StartupMessage received are sent on paramsCh.
+func startFakeBackend(ln net.Listener, cfg *tls.Config, paramsCh chan<- map[string]string) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+				if m, err := be.ReceiveStartupMessage(); err != nil {
+					return
+				} else if _, ok := m.(*pgproto3.SSLRequest); !ok {
+					return
+				}
+				if _, err := conn.Write([]byte("S")); err != nil {
+					return
+				}
+				conn := tls.Server(conn, cfg)
+				be = pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+				m, err := be.ReceiveStartupMessage()
+				if err != nil {
+					return
+				}
+				msg, ok := m.(*pgproto3.StartupMessage)
+				if !ok {
+					return
+				}
+				paramsCh <- msg.Parameters
+				_ = be.Send(&pgproto3.AuthenticationOk{})
+				_ = be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+				// Wait for the client to hang up.
+				_, _ = be.Receive()
+			}()
+		}
+	}()
+}
+
+func TestProxyWake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	backendAddr := backendLn.Addr().String()
+	// Close the listener so that the backend is unreachable until we restart
+	// it below.
+	require.NoError(t, backendLn.Close())
+	backendCfg := fakeBackendTLSConfig(t)
+
+	mem := NewMemDirectory()
+	mem.SetStarting("29")
+	mem.SetStarting("30")
+	lookup := AddrFromDirectory(mem, testingTenantFromDatabase)
+
+	// Tenant 30 never comes up.
+	opts := Options{
+		OutgoingAddrFromParams: lookup,
+		WakeBudget:             50 * time.Millisecond,
+		WakePollInterval:       5 * time.Millisecond,
+	}
+	addr, done := setupTestProxyWithCerts(t, &opts)
+	defer done()
+	assertConnectErr(t, fmt.Sprintf("postgres://unused:unused@%s/", addr), "defaultdb_30?sslmode=require",
+		"timed out waiting for backend SQL server to start")
+
+	// Tenant 29 gets an address on the second lookup, but its backend only
+	// starts listening after a dial attempt was refused. Each lookup after
+	// the first is preceded by a failed attempt, so this is driven by the
+	// polling of the proxy rather than by timing. The budget is generous so
+	// that the test doesn't depend on how quickly the proxy polls.
+	paramsCh := make(chan map[string]string, 1)
+	var lookups int32
+	opts = Options{
+		OutgoingAddrFromParams: func(lookupCtx context.Context, p map[string]string) (string, error) {
+			switch atomic.AddInt32(&lookups, 1) {
+			case 2:
+				mem.Set("29", backendAddr)
+			case 4:
+				ln, err := net.Listen("tcp", backendAddr)
+				if err != nil {
+					t.Error(err)
+					break
+				}
+				startFakeBackend(ln, backendCfg, paramsCh)
+				go func() {
+					<-ctx.Done()
+					_ = ln.Close()
+				}()
+			}
+			return lookup(lookupCtx, p)
+		},
+		WakeBudget:       10 * time.Second,
+		WakePollInterval: 5 * time.Millisecond,
+	}
+	addr, done = setupTestProxyWithCerts(t, &opts)
+	defer done()
+
+	conn, err := pgx.Connect(ctx, fmt.Sprintf("postgres://unused:unused@%s/defaultdb_29?sslmode=require", addr))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close(ctx))
+	require.Equal(t, "defaultdb", (<-paramsCh)["database"])
+	require.EqualValues(t, 4, atomic.LoadInt32(&lookups))
+}
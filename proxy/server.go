@@ -37,5 +37,4 @@ func Serve(ln net.Listener, opts Options) error {
 				conn.RemoteAddr(), time.Since(tBegin).Seconds(), err)
 		}()
 	}
-	return nil
 }